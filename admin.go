@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// isChatAdmin reports whether userID is the owner or an administrator of chatID
+func isChatAdmin(ctx context.Context, b *bot.Bot, chatID, userID int64) (bool, error) {
+	member, err := b.GetChatMember(ctx, &bot.GetChatMemberParams{
+		ChatID: chatID,
+		UserID: userID,
+	})
+	if err != nil {
+		return false, err
+	}
+	return member.Type == models.ChatMemberTypeOwner || member.Type == models.ChatMemberTypeAdministrator, nil
+}
+
+// canConfigureChat reports whether userID may change the character and settings
+// of chatID: their own private chat, or a group they administer
+func canConfigureChat(ctx context.Context, b *bot.Bot, chatID, userID int64) bool {
+	if chatID == userID {
+		return true
+	}
+	admin, err := isChatAdmin(ctx, b, chatID, userID)
+	if err != nil {
+		log.Printf("Error checking whether user %d administers chat %d: %v", userID, chatID, err)
+		return false
+	}
+	return admin
+}
+
+// commandArgs returns the text following the command of a message
+func commandArgs(text string) string {
+	parts := strings.Fields(text)
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(text[strings.Index(text, parts[0])+len(parts[0]):])
+}
+
+// resolveConfigTarget returns the chat a configuration command applies to,
+// along with the rest of its arguments. In groups it is the group itself and
+// the sender must administer it. In private chats the arguments may start with
+// the (negative) ID of a group the sender administers, otherwise it is the
+// private chat. The sender is told why when the command isn't allowed.
+func resolveConfigTarget(ctx context.Context, b *bot.Bot, message *models.Message) (int64, string, bool) {
+	chatID := message.Chat.ID
+	args := commandArgs(message.Text)
+
+	reply := func(text string) {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   text,
+		})
+	}
+
+	if message.Chat.Type != models.ChatTypePrivate {
+		// Anonymous admins post on behalf of the group
+		if message.SenderChat != nil && message.SenderChat.ID == chatID {
+			return chatID, args, true
+		}
+		if message.From == nil || !canConfigureChat(ctx, b, chatID, message.From.ID) {
+			reply("Only the administrators of this group can use this command.")
+			return 0, "", false
+		}
+		return chatID, args, true
+	}
+
+	first := ""
+	if fields := strings.Fields(args); len(fields) > 0 {
+		first = fields[0]
+	}
+	target, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || target >= 0 {
+		return chatID, args, true
+	}
+	rest := args[len(first):]
+
+	if !isChatAllowed(target) {
+		reply("Sorry, this bot is not available in that chat.")
+		return 0, "", false
+	}
+	if !canConfigureChat(ctx, b, target, message.From.ID) {
+		reply(fmt.Sprintf("You must be an administrator of chat %d, and the bot a member of it, to configure it from here.", target))
+		return 0, "", false
+	}
+	return target, strings.TrimSpace(rest), true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// chatWorkerIdleTimeout is how long a chat worker waits for new work before exiting
+const chatWorkerIdleTimeout = time.Minute
+
+// chatWorker runs the updates of a single chat one at a time
+type chatWorker struct {
+	jobs chan func()
+}
+
+// chatWorkQueue serializes the processing of updates per chat, while different
+// chats proceed in parallel. Workers are started on demand and exit when idle.
+type chatWorkQueue struct {
+	mu      sync.Mutex
+	workers map[int64]*chatWorker
+	size    int
+
+	processed atomic.Int64
+	dropped   atomic.Int64
+}
+
+var chatQueue *chatWorkQueue
+
+func newChatWorkQueue(size int) *chatWorkQueue {
+	return &chatWorkQueue{
+		workers: make(map[int64]*chatWorker),
+		size:    size,
+	}
+}
+
+// submit queues job for chatID, returning false when the chat backlog is full
+func (q *chatWorkQueue) submit(chatID int64, job func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	worker, ok := q.workers[chatID]
+	if !ok {
+		worker = &chatWorker{jobs: make(chan func(), q.size)}
+		q.workers[chatID] = worker
+		go q.run(chatID, worker)
+	}
+
+	select {
+	case worker.jobs <- job:
+		return true
+	default:
+		q.dropped.Add(1)
+		return false
+	}
+}
+
+// run processes the jobs of a chat until it has been idle for chatWorkerIdleTimeout
+func (q *chatWorkQueue) run(chatID int64, worker *chatWorker) {
+	idle := time.NewTimer(chatWorkerIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case job := <-worker.jobs:
+			job()
+			q.processed.Add(1)
+			idle.Reset(chatWorkerIdleTimeout)
+		case <-idle.C:
+			// Jobs are only submitted under the lock, so an empty queue stays empty
+			q.mu.Lock()
+			if len(worker.jobs) == 0 {
+				delete(q.workers, chatID)
+				q.mu.Unlock()
+				return
+			}
+			q.mu.Unlock()
+			idle.Reset(chatWorkerIdleTimeout)
+		}
+	}
+}
+
+// backlog returns the number of queued jobs per chat
+func (q *chatWorkQueue) backlog() map[int64]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	backlog := make(map[int64]int, len(q.workers))
+	for chatID, worker := range q.workers {
+		backlog[chatID] = len(worker.jobs)
+	}
+	return backlog
+}
+
+// metricsHandler exposes the queue metrics in the Prometheus text format
+func (q *chatWorkQueue) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	backlog := q.backlog()
+	chatIDs := make([]int64, 0, len(backlog))
+	total := 0
+	for chatID, n := range backlog {
+		chatIDs = append(chatIDs, chatID)
+		total += n
+	}
+	sort.Slice(chatIDs, func(i, j int) bool { return chatIDs[i] < chatIDs[j] })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP chat_queue_backlog Updates waiting to be processed per chat.")
+	fmt.Fprintln(w, "# TYPE chat_queue_backlog gauge")
+	for _, chatID := range chatIDs {
+		fmt.Fprintf(w, "chat_queue_backlog{chat_id=\"%d\"} %d\n", chatID, backlog[chatID])
+	}
+	fmt.Fprintln(w, "# HELP chat_queue_backlog_total Updates waiting to be processed in all chats.")
+	fmt.Fprintln(w, "# TYPE chat_queue_backlog_total gauge")
+	fmt.Fprintf(w, "chat_queue_backlog_total %d\n", total)
+	fmt.Fprintln(w, "# HELP chat_queue_workers Chats with an active worker.")
+	fmt.Fprintln(w, "# TYPE chat_queue_workers gauge")
+	fmt.Fprintf(w, "chat_queue_workers %d\n", len(backlog))
+	fmt.Fprintln(w, "# HELP chat_queue_processed_total Updates processed.")
+	fmt.Fprintln(w, "# TYPE chat_queue_processed_total counter")
+	fmt.Fprintf(w, "chat_queue_processed_total %d\n", q.processed.Load())
+	fmt.Fprintln(w, "# HELP chat_queue_dropped_total Updates dropped because the chat backlog was full.")
+	fmt.Fprintln(w, "# TYPE chat_queue_dropped_total counter")
+	fmt.Fprintf(w, "chat_queue_dropped_total %d\n", q.dropped.Load())
+}
+
+// updateChatID returns the chat an update belongs to
+func updateChatID(update *models.Update) (int64, bool) {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat.ID, true
+	case update.EditedMessage != nil:
+		return update.EditedMessage.Chat.ID, true
+	case update.CallbackQuery != nil && update.CallbackQuery.Message.Message != nil:
+		return update.CallbackQuery.Message.Message.Chat.ID, true
+	case update.MessageReaction != nil:
+		return update.MessageReaction.Chat.ID, true
+	default:
+		return 0, false
+	}
+}
+
+// serializeChatMiddleware runs the updates of a chat one after the other, in the
+// order they arrived, so storage and replies of the same chat never race
+func serializeChatMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		chatID, ok := updateChatID(update)
+		if !ok {
+			next(ctx, b, update)
+			return
+		}
+
+		if !chatQueue.submit(chatID, func() { next(ctx, b, update) }) {
+			log.Printf("Dropping update %d: backlog of chat %d is full", update.ID, chatID)
+		}
+	}
+}
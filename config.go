@@ -5,19 +5,123 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// LLMProviderConfig describes an OpenAI-compatible endpoint
+type LLMProviderConfig struct {
+	Name    string
+	BaseURL string
+	APIKey  string
+}
+
+// LLMTaskConfig maps a task (e.g. reply generation) to a provider, a model and its parameters
+type LLMTaskConfig struct {
+	Provider        string
+	Model           string
+	ReasoningEffort string          // Empty to leave the provider default
+	Temperature     float64         // Negative to leave the provider default
+	MaxTokens       int64           // Zero to leave the provider default
+	ContextTokens   int             // Prompt budget, it must fit the fallback models too
+	Fallbacks       []LLMTaskConfig // Routes tried in order when this one fails
+}
+
+// LLMRetryConfig controls how failed LLM calls are retried on the same provider
+type LLMRetryConfig struct {
+	MaxAttempts    int           // Attempts per provider, including the first one
+	InitialBackoff time.Duration // Doubled after every failed attempt
+	MaxBackoff     time.Duration
+	Timeout        time.Duration // Per attempt, zero to disable
+}
+
+// TranscriptionConfig selects how voice messages are turned into text
+type TranscriptionConfig struct {
+	Backend  string   // One of "none", "api" or "command"
+	Provider string   // LLM provider serving /audio/transcriptions, for the api backend
+	Model    string   // Transcription model of the api backend
+	Command  []string // Command line of the command backend, "{file}" is replaced by the audio path
+}
+
+// SpeechConfig selects how voice replies are spoken
+type SpeechConfig struct {
+	Backend  string   // One of "none", "api" or "command"
+	Provider string   // LLM provider serving /audio/speech, for the api backend
+	Model    string   // Text-to-speech model of the api backend
+	Voice    string   // Voice of the api backend
+	Command  []string // Command line of the command backend, "{file}" is replaced by the output path
+}
+
+// RetrievalConfig controls the semantic search over the chat archive
+type RetrievalConfig struct {
+	Provider   string // LLM provider serving /embeddings, empty to disable retrieval
+	Model      string // Embedding model
+	Dimensions int64  // Embedding size requested from the model, zero for its default
+	TopK       int    // Older messages added to the reply prompt
+}
+
+// defaultContextTokens is the prompt budget of routes that don't set one
+const defaultContextTokens = 32000
+
+// LLM tasks routed through the provider registry
+const (
+	LLMTaskReply       = "reply"
+	LLMTaskOverview    = "overview"
+	LLMTaskShouldReply = "should_reply"
+	LLMTaskVision      = "vision"
+	LLMTaskMemory      = "memory"
+)
+
+// Built-in providers and task routes, used when not overridden by the environment
+var (
+	defaultLLMProviders = map[string]LLMProviderConfig{
+		"grok":   {Name: "grok", BaseURL: "https://api.x.ai/v1"},
+		"gemini": {Name: "gemini", BaseURL: "https://generativelanguage.googleapis.com/v1beta/openai/"},
+	}
+	defaultLLMTasks = map[string]LLMTaskConfig{
+		LLMTaskReply: {Provider: "grok", Model: "grok-3-mini-beta", ReasoningEffort: "low", Temperature: -1, ContextTokens: 64000,
+			Fallbacks: []LLMTaskConfig{{Provider: "gemini", Model: "gemini-2.0-flash", Temperature: -1}}},
+		LLMTaskOverview:    {Provider: "gemini", Model: "gemini-2.5-pro-preview-03-25", Temperature: -1, ContextTokens: 500000},
+		LLMTaskShouldReply: {Provider: "grok", Model: "grok-3-mini-beta", ReasoningEffort: "low", Temperature: -1, ContextTokens: 4000},
+		LLMTaskVision:      {Provider: "gemini", Model: "gemini-2.0-flash", Temperature: -1, MaxTokens: 300, ContextTokens: 4000},
+		LLMTaskMemory:      {Provider: "gemini", Model: "gemini-2.0-flash", Temperature: -1, ContextTokens: 32000},
+	}
+)
+
 type Config struct {
-	TelegramBotToken       string
-	GrokApiKey             string
-	GeminiApiKey           string
-	RedisAddr              string
-	RedisPassword          string
-	HttpServerPort         string
-	AllowedChatIDs         []int64
-	GroupReplyProbability  float64 // Probability (0.0-1.0) of replying to messages in group chats
+	TelegramBotToken        string
+	GrokApiKey              string
+	GeminiApiKey            string
+	LLMProviders            map[string]LLMProviderConfig
+	LLMTasks                map[string]LLMTaskConfig
+	LLMRetry                LLMRetryConfig
+	LLMReplyModels          []LLMTaskConfig // Reply routes selectable per chat with /settings
+	Transcription           TranscriptionConfig
+	Speech                  SpeechConfig
+	Retrieval               RetrievalConfig
+	StorageBackend          string // One of "redis", "memory" or "sqlite"
+	SQLitePath              string
+	RedisAddr               string
+	RedisPassword           string
+	HttpServerPort          string
+	WebhookURL              string // Public base URL, empty to use long polling
+	WebhookPath             string
+	WebhookSecretToken      string
+	AllowedChatIDs          []int64
+	GroupReplyMode          string                  // How to decide whether to answer group messages not addressed to the bot
+	GroupReplyProbability   float64                 // Probability (0.0-1.0) of replying to messages in group chats
+	StreamReplies           bool                    // Send replies while they are generated, editing the message
+	ReplyDebounce           time.Duration           // Quiet period before answering a burst of messages, zero to disable
+	ChatQueueSize           int                     // Maximum updates waiting to be processed per chat
+	MetricsAddr             string                  // Private listen address of /metrics, empty to disable it
+	DescribeImages          bool                    // Describe photos and stickers with the vision task
+	MemoryExtractEvery      int                     // New messages between memory extractions, zero to disable
+	MemoryMaxPerUser        int                     // Memories kept per chat member, the oldest are dropped
+	StreamEditInterval      time.Duration           // Minimum time between edits of a streamed reply
+	ReplyDelayPerChar       time.Duration           // Simulated typing time per reply character, zero to disable
+	ReplyDelayMax           time.Duration           // Upper bound of the simulated typing time
+	ReplyDelayChatOverrides map[int64]time.Duration // Per-chat ReplyDelayPerChar
 }
 
 func loadConfig() (Config, error) {
@@ -29,10 +133,22 @@ func loadConfig() (Config, error) {
 	config.TelegramBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
 	config.GrokApiKey = os.Getenv("GROK_API_KEY")
 	config.GeminiApiKey = os.Getenv("GEMINI_API_KEY")
+	config.StorageBackend = getEnv("STORAGE_BACKEND", StorageBackendRedis)
+	config.SQLitePath = getEnv("SQLITE_PATH", "character-tg.db")
 	config.RedisAddr = getEnv("REDIS_ADDR", "localhost:6379")
 	config.RedisPassword = os.Getenv("REDIS_PASSWORD")
 	config.HttpServerPort = getEnv("PORT", "8080")
-	
+	config.WebhookURL = os.Getenv("WEBHOOK_URL")
+	config.WebhookPath = getEnv("WEBHOOK_PATH", "/telegram/webhook")
+	config.WebhookSecretToken = os.Getenv("WEBHOOK_SECRET_TOKEN")
+
+	config.GroupReplyMode = getEnv("GROUP_REPLY_MODE", GroupReplyModeModel)
+	switch config.GroupReplyMode {
+	case GroupReplyModeProbability, GroupReplyModeHeuristic, GroupReplyModeModel, GroupReplyModeReply:
+	default:
+		return config, fmt.Errorf("invalid GROUP_REPLY_MODE value: %s", config.GroupReplyMode)
+	}
+
 	// Parse group reply probability from environment variable (default to 1.0 - always reply)
 	probabilityStr := getEnv("GROUP_REPLY_PROBABILITY", "1.0")
 	var probability float64
@@ -49,7 +165,48 @@ func loadConfig() (Config, error) {
 	}
 	config.GroupReplyProbability = probability
 	log.Printf("Group chat reply probability set to: %.2f", probability)
-	
+
+	// Parse streaming options
+	config.StreamReplies = getEnv("STREAM_REPLIES", "false") == "true"
+	editInterval, err := time.ParseDuration(getEnv("STREAM_EDIT_INTERVAL", "1500ms"))
+	if err != nil || editInterval <= 0 {
+		return config, fmt.Errorf("invalid STREAM_EDIT_INTERVAL value: %s", os.Getenv("STREAM_EDIT_INTERVAL"))
+	}
+	config.StreamEditInterval = editInterval
+
+	// Parse burst debounce
+	if config.ReplyDebounce, err = time.ParseDuration(getEnv("REPLY_DEBOUNCE", "2s")); err != nil || config.ReplyDebounce < 0 {
+		return config, fmt.Errorf("invalid REPLY_DEBOUNCE value: %s", os.Getenv("REPLY_DEBOUNCE"))
+	}
+
+	// Parse vision options
+	config.DescribeImages = getEnv("DESCRIBE_IMAGES", "true") == "true"
+
+	// Parse long-term memory options
+	if _, err := fmt.Sscanf(getEnv("MEMORY_EXTRACT_EVERY", "30"), "%d", &config.MemoryExtractEvery); err != nil || config.MemoryExtractEvery < 0 {
+		return config, fmt.Errorf("invalid MEMORY_EXTRACT_EVERY value: %s", os.Getenv("MEMORY_EXTRACT_EVERY"))
+	}
+	if _, err := fmt.Sscanf(getEnv("MEMORY_MAX_PER_USER", "30"), "%d", &config.MemoryMaxPerUser); err != nil || config.MemoryMaxPerUser <= 0 {
+		return config, fmt.Errorf("invalid MEMORY_MAX_PER_USER value: %s", os.Getenv("MEMORY_MAX_PER_USER"))
+	}
+
+	// Parse per-chat queue size
+	config.MetricsAddr = os.Getenv("METRICS_ADDR")
+	if _, err := fmt.Sscanf(getEnv("CHAT_QUEUE_SIZE", "100"), "%d", &config.ChatQueueSize); err != nil || config.ChatQueueSize <= 0 {
+		return config, fmt.Errorf("invalid CHAT_QUEUE_SIZE value: %s", os.Getenv("CHAT_QUEUE_SIZE"))
+	}
+
+	// Parse human-like reply delay
+	if config.ReplyDelayPerChar, err = time.ParseDuration(getEnv("REPLY_DELAY_PER_CHAR", "0")); err != nil || config.ReplyDelayPerChar < 0 {
+		return config, fmt.Errorf("invalid REPLY_DELAY_PER_CHAR value: %s", os.Getenv("REPLY_DELAY_PER_CHAR"))
+	}
+	if config.ReplyDelayMax, err = time.ParseDuration(getEnv("REPLY_DELAY_MAX", "10s")); err != nil || config.ReplyDelayMax < 0 {
+		return config, fmt.Errorf("invalid REPLY_DELAY_MAX value: %s", os.Getenv("REPLY_DELAY_MAX"))
+	}
+	if config.ReplyDelayChatOverrides, err = parseChatDurations(os.Getenv("REPLY_DELAY_CHATS")); err != nil {
+		return config, fmt.Errorf("invalid REPLY_DELAY_CHATS value: %w", err)
+	}
+
 	// Parse allowed chat IDs from environment variable
 	allowedChatsStr := os.Getenv("ALLOWED_CHAT_IDS")
 	if allowedChatsStr != "" {
@@ -65,17 +222,74 @@ func loadConfig() (Config, error) {
 	if config.TelegramBotToken == "" {
 		return config, fmt.Errorf("TELEGRAM_BOT_TOKEN environment variable not set")
 	}
-	if config.GrokApiKey == "" {
-		return config, fmt.Errorf("GROK_API_KEY environment variable not set")
+	providers, err := parseLLMProviders(config)
+	if err != nil {
+		return config, err
 	}
-	if config.GeminiApiKey == "" {
-		return config, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+	config.LLMProviders = providers
+
+	tasks, err := parseLLMTasks(providers)
+	if err != nil {
+		return config, err
 	}
-	if config.RedisAddr == "" {
-		return config, fmt.Errorf("REDIS_ADDR environment variable not set")
+	config.LLMTasks = tasks
+
+	retry, err := parseLLMRetry()
+	if err != nil {
+		return config, err
 	}
-	if config.RedisPassword == "" {
-		return config, fmt.Errorf("REDIS_PASSWORD environment variable not set")
+	config.LLMRetry = retry
+
+	replyModels, err := parseLLMReplyModels(providers, tasks[LLMTaskReply])
+	if err != nil {
+		return config, err
+	}
+	config.LLMReplyModels = replyModels
+
+	transcription, err := parseTranscription(providers)
+	if err != nil {
+		return config, err
+	}
+	config.Transcription = transcription
+
+	speech, err := parseSpeech(providers)
+	if err != nil {
+		return config, err
+	}
+	config.Speech = speech
+
+	retrieval, err := parseRetrieval(providers)
+	if err != nil {
+		return config, err
+	}
+	config.Retrieval = retrieval
+
+	if config.WebhookURL != "" {
+		if !strings.HasPrefix(config.WebhookURL, "https://") {
+			return config, fmt.Errorf("WEBHOOK_URL must be an https URL")
+		}
+		if !strings.HasPrefix(config.WebhookPath, "/") {
+			return config, fmt.Errorf("WEBHOOK_PATH must start with /")
+		}
+		if !isValidSecretToken(config.WebhookSecretToken) {
+			return config, fmt.Errorf("WEBHOOK_SECRET_TOKEN must be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+		}
+	}
+	switch config.StorageBackend {
+	case StorageBackendRedis:
+		if config.RedisAddr == "" {
+			return config, fmt.Errorf("REDIS_ADDR environment variable not set")
+		}
+		if config.RedisPassword == "" {
+			return config, fmt.Errorf("REDIS_PASSWORD environment variable not set")
+		}
+	case StorageBackendSQLite:
+		if config.SQLitePath == "" {
+			return config, fmt.Errorf("SQLITE_PATH environment variable not set")
+		}
+	case StorageBackendMemory:
+	default:
+		return config, fmt.Errorf("invalid STORAGE_BACKEND value: %s", config.StorageBackend)
 	}
 	return config, nil
 }
@@ -90,30 +304,339 @@ func getEnv(key, fallback string) string {
 	return value
 }
 
+// isValidSecretToken checks the webhook secret token against the charset Telegram accepts
+func isValidSecretToken(token string) bool {
+	if len(token) == 0 || len(token) > 256 {
+		return false
+	}
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseChatDurations parses a comma-separated list of chat ID and duration pairs
+// Format example: "-1001234567890:50ms,123456789:0"
+func parseChatDurations(input string) (map[int64]time.Duration, error) {
+	result := make(map[int64]time.Duration)
+
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		chatIDStr, durationStr, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid chat duration format: %s", part)
+		}
+		chatID, err := parseInt64(chatIDStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat ID format: %s", chatIDStr)
+		}
+		duration, err := time.ParseDuration(durationStr)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid duration format: %s", durationStr)
+		}
+
+		result[chatID] = duration
+	}
+
+	return result, nil
+}
+
 // parseAllowedChatIDs parses a comma-separated list of chat IDs
 // Format example: "-1001234567890,123456789"
 func parseAllowedChatIDs(input string) ([]int64, error) {
 	if input == "" {
 		return nil, nil
 	}
-	
+
 	parts := strings.Split(input, ",")
 	result := make([]int64, 0, len(parts))
-	
+
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
 		if part == "" {
 			continue
 		}
-		
+
 		var chatID int64
 		n, err := fmt.Sscanf(part, "%d", &chatID)
 		if err != nil || n != 1 {
 			return nil, fmt.Errorf("invalid chat ID format: %s", part)
 		}
-		
+
 		result = append(result, chatID)
 	}
-	
+
 	return result, nil
 }
+
+// parseLLMProviders reads the providers listed in LLM_PROVIDERS (default "grok,gemini").
+// Each provider is configured with LLM_PROVIDER_<NAME>_BASE_URL and LLM_PROVIDER_<NAME>_API_KEY;
+// the built-in grok and gemini providers fall back to GROK_API_KEY and GEMINI_API_KEY.
+func parseLLMProviders(config Config) (map[string]LLMProviderConfig, error) {
+	providers := make(map[string]LLMProviderConfig)
+
+	for _, name := range strings.Split(getEnv("LLM_PROVIDERS", "grok,gemini"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		provider := defaultLLMProviders[name]
+		provider.Name = name
+		switch name {
+		case "grok":
+			provider.APIKey = config.GrokApiKey
+		case "gemini":
+			provider.APIKey = config.GeminiApiKey
+		}
+
+		prefix := "LLM_PROVIDER_" + strings.ToUpper(name) + "_"
+		provider.BaseURL = getEnv(prefix+"BASE_URL", provider.BaseURL)
+		provider.APIKey = getEnv(prefix+"API_KEY", provider.APIKey)
+
+		if provider.BaseURL == "" {
+			return nil, fmt.Errorf("%sBASE_URL environment variable not set", prefix)
+		}
+		if provider.APIKey == "" {
+			log.Printf("warning: no API key configured for LLM provider %s", name)
+		}
+		providers[name] = provider
+	}
+
+	return providers, nil
+}
+
+// Route returns the "provider:model" form of the task route
+func (t LLMTaskConfig) Route() string {
+	return t.Provider + ":" + t.Model
+}
+
+// parseLLMRoute parses a "provider:model" route. The model may itself contain colons.
+func parseLLMRoute(route string) (LLMTaskConfig, error) {
+	provider, model, found := strings.Cut(strings.TrimSpace(route), ":")
+	if !found || provider == "" || model == "" {
+		return LLMTaskConfig{}, fmt.Errorf("invalid route %q, expected provider:model", route)
+	}
+	return LLMTaskConfig{Provider: strings.ToLower(provider), Model: model, Temperature: -1, ContextTokens: defaultContextTokens}, nil
+}
+
+// parseLLMTasks reads the route of every known task from LLM_TASK_<TASK> in the
+// "provider:model" format, plus the optional LLM_TASK_<TASK>_REASONING_EFFORT,
+// LLM_TASK_<TASK>_TEMPERATURE, LLM_TASK_<TASK>_MAX_TOKENS and LLM_TASK_<TASK>_CONTEXT_TOKENS parameters.
+// LLM_TASK_<TASK>_FALLBACK is a comma-separated list of routes tried in order
+// when the main one fails, "none" disables the built-in fallbacks.
+func parseLLMTasks(providers map[string]LLMProviderConfig) (map[string]LLMTaskConfig, error) {
+	tasks := make(map[string]LLMTaskConfig)
+
+	for name, task := range defaultLLMTasks {
+		prefix := "LLM_TASK_" + strings.ToUpper(name)
+
+		if route := os.Getenv(prefix); route != "" {
+			// Parameters of the built-in route don't apply to a different model
+			fallbacks := task.Fallbacks
+			var err error
+			if task, err = parseLLMRoute(route); err != nil {
+				return nil, fmt.Errorf("invalid %s value: %w", prefix, err)
+			}
+			task.Fallbacks = fallbacks
+		}
+
+		if fallbackStr := os.Getenv(prefix + "_FALLBACK"); fallbackStr != "" {
+			task.Fallbacks = nil
+			if fallbackStr != "none" {
+				for _, route := range strings.Split(fallbackStr, ",") {
+					fallback, err := parseLLMRoute(route)
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s_FALLBACK value: %w", prefix, err)
+					}
+					task.Fallbacks = append(task.Fallbacks, fallback)
+				}
+			}
+		}
+
+		task.ReasoningEffort = getEnv(prefix+"_REASONING_EFFORT", task.ReasoningEffort)
+
+		if temperatureStr := os.Getenv(prefix + "_TEMPERATURE"); temperatureStr != "" {
+			if _, err := fmt.Sscanf(temperatureStr, "%f", &task.Temperature); err != nil {
+				return nil, fmt.Errorf("invalid %s_TEMPERATURE value: %s", prefix, temperatureStr)
+			}
+		}
+
+		if maxTokensStr := os.Getenv(prefix + "_MAX_TOKENS"); maxTokensStr != "" {
+			if _, err := fmt.Sscanf(maxTokensStr, "%d", &task.MaxTokens); err != nil {
+				return nil, fmt.Errorf("invalid %s_MAX_TOKENS value: %s", prefix, maxTokensStr)
+			}
+		}
+
+		if contextTokensStr := os.Getenv(prefix + "_CONTEXT_TOKENS"); contextTokensStr != "" {
+			if _, err := fmt.Sscanf(contextTokensStr, "%d", &task.ContextTokens); err != nil || task.ContextTokens <= 0 {
+				return nil, fmt.Errorf("invalid %s_CONTEXT_TOKENS value: %s", prefix, contextTokensStr)
+			}
+		}
+
+		routes := []string{task.Route()}
+		for _, route := range append([]LLMTaskConfig{task}, task.Fallbacks...) {
+			if _, ok := providers[route.Provider]; !ok {
+				return nil, fmt.Errorf("%s uses unknown LLM provider %q, add it to LLM_PROVIDERS", prefix, route.Provider)
+			}
+		}
+		for _, fallback := range task.Fallbacks {
+			routes = append(routes, fallback.Route())
+		}
+
+		log.Printf("LLM task %s routed to %s", name, strings.Join(routes, " -> "))
+		tasks[name] = task
+	}
+
+	return tasks, nil
+}
+
+// parseLLMReplyModels reads the comma-separated routes of LLM_REPLY_MODELS that
+// chats can pick for their replies, by default the reply route and its fallbacks
+func parseLLMReplyModels(providers map[string]LLMProviderConfig, reply LLMTaskConfig) ([]LLMTaskConfig, error) {
+	modelsStr := os.Getenv("LLM_REPLY_MODELS")
+	if modelsStr == "" {
+		return append([]LLMTaskConfig{reply}, reply.Fallbacks...), nil
+	}
+
+	var models []LLMTaskConfig
+	for _, route := range strings.Split(modelsStr, ",") {
+		model, err := parseLLMRoute(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LLM_REPLY_MODELS value: %w", err)
+		}
+		if _, ok := providers[model.Provider]; !ok {
+			return nil, fmt.Errorf("LLM_REPLY_MODELS uses unknown LLM provider %q, add it to LLM_PROVIDERS", model.Provider)
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// parseLLMRetry reads the retry policy from LLM_RETRY_MAX_ATTEMPTS, LLM_RETRY_INITIAL_BACKOFF,
+// LLM_RETRY_MAX_BACKOFF and LLM_REQUEST_TIMEOUT. Durations use the time.ParseDuration format.
+func parseLLMRetry() (LLMRetryConfig, error) {
+	retry := LLMRetryConfig{MaxAttempts: 3}
+
+	attemptsStr := getEnv("LLM_RETRY_MAX_ATTEMPTS", "3")
+	if _, err := fmt.Sscanf(attemptsStr, "%d", &retry.MaxAttempts); err != nil || retry.MaxAttempts < 1 {
+		return retry, fmt.Errorf("invalid LLM_RETRY_MAX_ATTEMPTS value: %s", attemptsStr)
+	}
+
+	durations := []struct {
+		key      string
+		fallback string
+		value    *time.Duration
+	}{
+		{"LLM_RETRY_INITIAL_BACKOFF", "1s", &retry.InitialBackoff},
+		{"LLM_RETRY_MAX_BACKOFF", "10s", &retry.MaxBackoff},
+		{"LLM_REQUEST_TIMEOUT", "0", &retry.Timeout},
+	}
+	for _, d := range durations {
+		value, err := time.ParseDuration(getEnv(d.key, d.fallback))
+		if err != nil || value < 0 {
+			return retry, fmt.Errorf("invalid %s value: %s", d.key, os.Getenv(d.key))
+		}
+		*d.value = value
+	}
+
+	return retry, nil
+}
+
+// parseTranscription reads the voice transcription backend from TRANSCRIPTION_BACKEND.
+// The api backend calls the /audio/transcriptions endpoint of TRANSCRIPTION_PROVIDER
+// with TRANSCRIPTION_MODEL, the command backend runs TRANSCRIPTION_COMMAND and reads
+// the transcript from its standard output.
+func parseTranscription(providers map[string]LLMProviderConfig) (TranscriptionConfig, error) {
+	transcription := TranscriptionConfig{
+		Backend:  getEnv("TRANSCRIPTION_BACKEND", TranscriptionBackendNone),
+		Provider: strings.ToLower(os.Getenv("TRANSCRIPTION_PROVIDER")),
+		Model:    getEnv("TRANSCRIPTION_MODEL", "whisper-1"),
+		Command:  strings.Fields(os.Getenv("TRANSCRIPTION_COMMAND")),
+	}
+
+	switch transcription.Backend {
+	case TranscriptionBackendNone:
+	case TranscriptionBackendAPI:
+		if _, ok := providers[transcription.Provider]; !ok {
+			return transcription, fmt.Errorf("TRANSCRIPTION_PROVIDER must be one of LLM_PROVIDERS, got %q", transcription.Provider)
+		}
+		log.Printf("Voice messages transcribed by %s:%s", transcription.Provider, transcription.Model)
+	case TranscriptionBackendCommand:
+		if len(transcription.Command) == 0 {
+			return transcription, fmt.Errorf("TRANSCRIPTION_COMMAND environment variable not set")
+		}
+		log.Printf("Voice messages transcribed by %s", transcription.Command[0])
+	default:
+		return transcription, fmt.Errorf("invalid TRANSCRIPTION_BACKEND value: %s", transcription.Backend)
+	}
+
+	return transcription, nil
+}
+
+// parseSpeech reads the text-to-speech backend of voice replies from TTS_BACKEND.
+// The api backend calls the /audio/speech endpoint of TTS_PROVIDER with TTS_MODEL
+// and TTS_VOICE, the command backend runs TTS_COMMAND with the text on its
+// standard input.
+func parseSpeech(providers map[string]LLMProviderConfig) (SpeechConfig, error) {
+	speech := SpeechConfig{
+		Backend:  getEnv("TTS_BACKEND", SpeechBackendNone),
+		Provider: strings.ToLower(os.Getenv("TTS_PROVIDER")),
+		Model:    getEnv("TTS_MODEL", "tts-1"),
+		Voice:    getEnv("TTS_VOICE", "alloy"),
+		Command:  strings.Fields(os.Getenv("TTS_COMMAND")),
+	}
+
+	switch speech.Backend {
+	case SpeechBackendNone:
+	case SpeechBackendAPI:
+		if _, ok := providers[speech.Provider]; !ok {
+			return speech, fmt.Errorf("TTS_PROVIDER must be one of LLM_PROVIDERS, got %q", speech.Provider)
+		}
+		log.Printf("Voice replies spoken by %s:%s with voice %s", speech.Provider, speech.Model, speech.Voice)
+	case SpeechBackendCommand:
+		if len(speech.Command) == 0 {
+			return speech, fmt.Errorf("TTS_COMMAND environment variable not set")
+		}
+		log.Printf("Voice replies spoken by %s", speech.Command[0])
+	default:
+		return speech, fmt.Errorf("invalid TTS_BACKEND value: %s", speech.Backend)
+	}
+
+	return speech, nil
+}
+
+// parseRetrieval reads the semantic search over the chat archive. It is enabled
+// by EMBEDDING_PROVIDER, whose /embeddings endpoint embeds the messages with
+// EMBEDDING_MODEL and the optional EMBEDDING_DIMENSIONS. RETRIEVAL_TOP_K older
+// messages are added to each reply prompt.
+func parseRetrieval(providers map[string]LLMProviderConfig) (RetrievalConfig, error) {
+	retrieval := RetrievalConfig{
+		Provider: strings.ToLower(os.Getenv("EMBEDDING_PROVIDER")),
+		Model:    getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
+	}
+	if retrieval.Provider == "" {
+		return retrieval, nil
+	}
+	if _, ok := providers[retrieval.Provider]; !ok {
+		return retrieval, fmt.Errorf("EMBEDDING_PROVIDER must be one of LLM_PROVIDERS, got %q", retrieval.Provider)
+	}
+
+	dimensionsStr := getEnv("EMBEDDING_DIMENSIONS", "0")
+	if _, err := fmt.Sscanf(dimensionsStr, "%d", &retrieval.Dimensions); err != nil || retrieval.Dimensions < 0 {
+		return retrieval, fmt.Errorf("invalid EMBEDDING_DIMENSIONS value: %s", dimensionsStr)
+	}
+	topKStr := getEnv("RETRIEVAL_TOP_K", "8")
+	if _, err := fmt.Sscanf(topKStr, "%d", &retrieval.TopK); err != nil || retrieval.TopK <= 0 {
+		return retrieval, fmt.Errorf("invalid RETRIEVAL_TOP_K value: %s", topKStr)
+	}
+
+	log.Printf("Chat archive searched with %s:%s, %d messages per reply", retrieval.Provider, retrieval.Model, retrieval.TopK)
+	return retrieval, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"unicode/utf8"
+)
+
+const (
+	// maxMessageTokens caps a single message, longer texts are truncated
+	maxMessageTokens = 1000
+	// minMessageTokens is the smallest cost of a serialized message, used to
+	// bound how many messages are read from storage for a given budget
+	minMessageTokens = 10
+	// truncationMarker is appended to truncated message texts
+	truncationMarker = " [...]"
+)
+
+// estimateTokens approximates the number of tokens of s. It assumes about
+// three characters per token, which overestimates English and stays safe for
+// languages that tokenize worse.
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 2) / 3
+}
+
+// estimateMessageTokens approximates the tokens used by message once serialized in the prompt
+func estimateMessageTokens(message ChatMessage) int {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return estimateTokens(message.Text) + minMessageTokens
+	}
+	// Separator between messages in the JSON array
+	return estimateTokens(string(data)) + 1
+}
+
+// truncateText cuts s to about maxTokens tokens
+func truncateText(s string, maxTokens int) string {
+	maxRunes := maxTokens * 3
+	if utf8.RuneCountInString(s) <= maxRunes {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:maxRunes]) + truncationMarker
+}
+
+// truncateMessage shortens the text and caption of huge messages
+func truncateMessage(message ChatMessage) ChatMessage {
+	if estimateMessageTokens(message) <= maxMessageTokens {
+		return message
+	}
+	message.Text = truncateText(message.Text, maxMessageTokens/2)
+	message.Caption = truncateText(message.Caption, maxMessageTokens/4)
+	return message
+}
+
+// historyFetchLimit returns how many messages may fit in budget, used as the
+// storage read limit so the whole history isn't loaded for every prompt.
+func historyFetchLimit(budget int) int {
+	return max(budget/minMessageTokens, 1)
+}
+
+// fitMessages keeps the most recent messages whose estimated tokens fit in
+// budget, trimming history oldest-first and skipping deleted messages. The
+// result is in chronological order.
+func fitMessages(messages []ChatMessage, budget int) []ChatMessage {
+	used := 0
+	fitted := make([]ChatMessage, 0)
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Deleted {
+			continue
+		}
+		message := truncateMessage(messages[i])
+		cost := estimateMessageTokens(message)
+		if used+cost > budget {
+			break
+		}
+		used += cost
+		fitted = append(fitted, message)
+	}
+
+	slices.Reverse(fitted)
+	return fitted
+}
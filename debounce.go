@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// pendingReply is the scheduled or running reply of a chat
+type pendingReply struct {
+	timer  *time.Timer
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the reply has run or was stopped before running
+}
+
+// replyDebouncer coalesces bursts of messages in a chat into a single reply.
+// Every new message restarts the quiet period and cancels the reply being
+// generated for the previous ones, the reply then covers the whole burst
+// since it is built from the stored history.
+type replyDebouncer struct {
+	mu      sync.Mutex
+	pending map[int64]*pendingReply
+}
+
+var debouncer = &replyDebouncer{pending: make(map[int64]*pendingReply)}
+
+// schedule runs run for chatID once no other message arrives for quiet,
+// superseding any reply already scheduled or running for the chat
+func (d *replyDebouncer) schedule(ctx context.Context, chatID int64, quiet time.Duration, run func(ctx context.Context)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Replies of a chat never overlap, the new one waits for the superseded one to stop
+	var prevDone chan struct{}
+	if prev, ok := d.pending[chatID]; ok {
+		if prev.timer.Stop() {
+			close(prev.done)
+		}
+		prev.cancel()
+		prevDone = prev.done
+		log.Printf("Superseding pending reply in chat %d", chatID)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	current := &pendingReply{cancel: cancel, done: make(chan struct{})}
+	current.timer = time.AfterFunc(quiet, func() {
+		defer func() {
+			d.mu.Lock()
+			if d.pending[chatID] == current {
+				delete(d.pending, chatID)
+			}
+			d.mu.Unlock()
+			cancel()
+			close(current.done)
+		}()
+
+		if prevDone != nil {
+			select {
+			case <-prevDone:
+			case <-ctx.Done():
+				return
+			}
+		}
+		run(ctx)
+	})
+	d.pending[chatID] = current
+}
+
+// debounceHandler delays next until the chat has been quiet for REPLY_DEBOUNCE,
+// so a burst of messages gets one reply instead of one per message
+func debounceHandler(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		// Only debounce messages the reply handler answers
+		if appConfig.ReplyDebounce == 0 || update.Message == nil || !canReply(update.Message) {
+			next(ctx, b, update)
+			return
+		}
+
+		debouncer.schedule(ctx, update.Message.Chat.ID, appConfig.ReplyDebounce, func(ctx context.Context) {
+			next(ctx, b, update)
+		})
+	}
+}
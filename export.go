@@ -1,9 +1,17 @@
 package main
 
 import (
+	"archive/zip"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
 )
 
 // ChatExport define the chat history structure of the json-format file from a telegram client.
@@ -40,6 +48,9 @@ type ChatExportMessage struct {
 	Edited            string       `json:"edited,omitempty"`                 // Could parse to time.Time
 	EditedUnixtime    int64        `json:"edited_unixtime,string,omitempty"` // JSON value is string, parse as number
 	ForwardedFrom     string       `json:"forwarded_from,omitempty"`
+	StickerEmoji      string       `json:"sticker_emoji,omitempty"`
+	Performer         string       `json:"performer,omitempty"`
+	Title             string       `json:"title,omitempty"`
 	Reactions         []Reaction   `json:"reactions,omitempty"`
 }
 
@@ -50,6 +61,13 @@ type TextEntity struct {
 	Href string `json:"href,omitempty"` // For text_link type
 }
 
+// exportMediaTypes maps the stored media types named after the Bot API to the
+// ones Telegram Desktop exports use
+var exportMediaTypes = map[string]string{
+	"voice":      "voice_message",
+	"video_note": "video_message",
+}
+
 // Reaction represents an emoji reaction to a message.
 type Reaction struct {
 	Type   string          `json:"type"` // e.g., "emoji"
@@ -72,9 +90,57 @@ func NewChatExport(filePath string) (ChatExport, error) {
 		return ChatExport{}, err
 	}
 
+	return parseChatExport(jsonData)
+}
+
+// maxExportJSONSize bounds the result.json read from an archive
+const maxExportJSONSize = 200 << 20
+
+// NewChatExportFromZip reads the result.json of a zipped Telegram Desktop export
+// folder. The archive may contain the export folder itself or only its content.
+func NewChatExportFromZip(filePath string) (ChatExport, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return ChatExport{}, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+
+	// The shallowest result.json is the one of the export, others could be attachments
+	var result *zip.File
+	for _, file := range archive.File {
+		if path.Base(file.Name) != "result.json" {
+			continue
+		}
+		if result == nil || strings.Count(file.Name, "/") < strings.Count(result.Name, "/") {
+			result = file
+		}
+	}
+	if result == nil {
+		return ChatExport{}, fmt.Errorf("no result.json in the archive, export the chat in the JSON format")
+	}
+
+	reader, err := result.Open()
+	if err != nil {
+		return ChatExport{}, fmt.Errorf("failed to open %s: %w", result.Name, err)
+	}
+	defer reader.Close()
+
+	jsonData, err := io.ReadAll(io.LimitReader(reader, maxExportJSONSize+1))
+	if err != nil {
+		return ChatExport{}, fmt.Errorf("failed to read %s: %w", result.Name, err)
+	}
+	if len(jsonData) > maxExportJSONSize {
+		return ChatExport{}, fmt.Errorf("%s is too large", result.Name)
+	}
+
+	return parseChatExport(jsonData)
+}
+
+// parseChatExport decodes the content of a result.json
+func parseChatExport(jsonData []byte) (ChatExport, error) {
 	var chatData ChatExport
 
-	err = json.Unmarshal(jsonData, &chatData)
+	err := json.Unmarshal(jsonData, &chatData)
 	if err != nil {
 		log.Printf("error unmarshaling JSON: %v", err)
 		return ChatExport{}, err
@@ -82,3 +148,213 @@ func NewChatExport(filePath string) (ChatExport, error) {
 
 	return chatData, nil
 }
+
+// exportDateLayout is the local time format Telegram Desktop uses for dates
+const exportDateLayout = "2006-01-02T15:04:05"
+
+// exportMediaPlaceholder is what Telegram Desktop writes for media not included in the export
+const exportMediaPlaceholder = "(File not included. Change data exporting settings to download.)"
+
+// NewChatExportFromMessages builds a Telegram Desktop compatible export of a stored chat
+func NewChatExportFromMessages(chat models.Chat, messages []ChatMessage) ChatExport {
+	name := chat.Title
+	if name == "" {
+		name = strings.TrimSpace(chat.FirstName + " " + chat.LastName)
+	}
+
+	return ChatExport{
+		Name:     name,
+		Type:     exportChatType(chat),
+		ID:       exportChatID(chat.ID),
+		Messages: ConvertToExportMessages(messages),
+	}
+}
+
+// exportChatType maps a Telegram chat to the chat type used in exports
+func exportChatType(chat models.Chat) string {
+	visibility := "private"
+	if chat.Username != "" {
+		visibility = "public"
+	}
+
+	switch chat.Type {
+	case models.ChatTypePrivate:
+		return "personal_chat"
+	case models.ChatTypeGroup:
+		return "private_group"
+	case models.ChatTypeSupergroup:
+		return visibility + "_supergroup"
+	case models.ChatTypeChannel:
+		return visibility + "_channel"
+	default:
+		return string(chat.Type)
+	}
+}
+
+// supergroupOffset is the -100 prefix of supergroup and channel IDs in the Bot API
+const supergroupOffset = 1000000000000
+
+// exportChatID converts a Bot API chat ID to the bare ID used in exports,
+// which drops the minus sign of groups and the -100 prefix of supergroups and channels
+func exportChatID(chatID int64) int64 {
+	switch {
+	case chatID <= -supergroupOffset:
+		return -chatID - supergroupOffset
+	case chatID < 0:
+		return -chatID
+	default:
+		return chatID
+	}
+}
+
+// liveChatID converts the bare ID of an export back to the Bot API chat ID that
+// live updates of the chat use. It returns false for personal chats, whose ID is
+// the other user's rather than a chat the bot can be in.
+func liveChatID(export ChatExport) (int64, bool) {
+	switch {
+	case export.ID < 0:
+		// Already a Bot API ID
+		return export.ID, true
+	case export.Type == "private_group":
+		return -export.ID, true
+	case strings.HasSuffix(export.Type, "_supergroup"), strings.HasSuffix(export.Type, "_channel"):
+		return -export.ID - supergroupOffset, true
+	default:
+		return 0, false
+	}
+}
+
+// ConvertToExportMessages converts an array of ChatMessage to an array of ChatExportMessage
+func ConvertToExportMessages(messages []ChatMessage) []ChatExportMessage {
+	result := make([]ChatExportMessage, 0, len(messages))
+	for _, message := range messages {
+		if message.Deleted {
+			continue
+		}
+		result = append(result, ToExportMessage(message))
+	}
+	return result
+}
+
+// ToExportMessage converts our internal ChatMessage to a ChatExportMessage
+func ToExportMessage(msg ChatMessage) ChatExportMessage {
+	// Exports merge captions into the message text
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+
+	exportMsg := ChatExportMessage{
+		ID:               msg.ID,
+		Type:             "message",
+		Date:             time.Unix(msg.Date, 0).Format(exportDateLayout),
+		DateUnixtime:     msg.Date,
+		From:             msg.FromUser,
+		ReplyToMessageID: msg.ReplyToID,
+		TextEntities:     buildTextEntities(text, msg.OriginalEntities),
+	}
+	exportMsg.Text = exportText(exportMsg.TextEntities)
+
+	if msg.FromID != 0 {
+		exportMsg.FromID = fmt.Sprintf("user%d", msg.FromID)
+	}
+
+	// Handle edited
+	if msg.EditDate > 0 {
+		exportMsg.Edited = time.Unix(msg.EditDate, 0).Format(exportDateLayout)
+		exportMsg.EditedUnixtime = msg.EditDate
+	}
+
+	for _, reaction := range msg.Reactions {
+		exportMsg.Reactions = append(exportMsg.Reactions, Reaction{Type: "emoji", Count: max(reaction.Count, 1), Emoji: reaction.Emoji})
+	}
+
+	// Handle media types, the files themselves are not part of the stored history
+	switch msg.MediaType {
+	case "":
+	case "photo":
+		exportMsg.Photo = exportMediaPlaceholder
+	case "document":
+		// Plain files have no media type in exports
+		exportMsg.File = exportMediaPlaceholder
+		exportMsg.FileName = msg.File
+	default:
+		exportMsg.MediaType = msg.MediaType
+		if exportType, ok := exportMediaTypes[msg.MediaType]; ok {
+			exportMsg.MediaType = exportType
+		}
+		exportMsg.File = exportMediaPlaceholder
+		exportMsg.FileName = msg.File
+	}
+	exportMsg.MimeType = msg.MimeType
+	exportMsg.DurationSeconds = msg.Duration
+	exportMsg.StickerEmoji = msg.Emoji
+	exportMsg.Title = msg.Title
+
+	return exportMsg
+}
+
+// buildTextEntities splits text into the entity list of an export. Entities
+// imported from an export already cover the whole text and are kept as they are,
+// live entities only cover formatted parts so the gaps are filled with plain text.
+func buildTextEntities(text string, entities []TextEntityRef) []TextEntity {
+	result := []TextEntity{}
+
+	var covered strings.Builder
+	for _, entity := range entities {
+		covered.WriteString(entity.Text)
+	}
+	if covered.String() == text {
+		for _, entity := range entities {
+			result = append(result, TextEntity{Type: entity.Type, Text: entity.Text, Href: entity.Href})
+		}
+		return result
+	}
+
+	rest := text
+	for _, entity := range entities {
+		i := strings.Index(rest, entity.Text)
+		if entity.Text == "" || i < 0 {
+			continue
+		}
+		if i > 0 {
+			result = append(result, TextEntity{Type: "plain", Text: rest[:i]})
+		}
+		result = append(result, TextEntity{Type: entity.Type, Text: entity.Text, Href: entity.Href})
+		rest = rest[i+len(entity.Text):]
+	}
+	if rest != "" {
+		result = append(result, TextEntity{Type: "plain", Text: rest})
+	}
+
+	return result
+}
+
+// exportText builds the text field of an export: a plain string when there is no
+// formatting, otherwise an array of plain strings and entity objects
+func exportText(entities []TextEntity) any {
+	formatted := false
+	for _, entity := range entities {
+		if entity.Type != "plain" {
+			formatted = true
+			break
+		}
+	}
+	if !formatted {
+		var text strings.Builder
+		for _, entity := range entities {
+			text.WriteString(entity.Text)
+		}
+		return text.String()
+	}
+
+	parts := make([]any, 0, len(entities))
+	for _, entity := range entities {
+		if entity.Type == "plain" {
+			parts = append(parts, entity.Text)
+		} else {
+			parts = append(parts, entity)
+		}
+	}
+	return parts
+}
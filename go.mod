@@ -2,14 +2,17 @@ module github.com/AlessandroGrassi99/character-tg
 
 go 1.24.0
 
-require github.com/go-telegram/bot v1.14.2
+require (
+	github.com/go-telegram/bot v1.14.2
+	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.52
+	github.com/openai/openai-go v0.1.0-beta.10
+	github.com/redis/go-redis/v9 v9.7.3
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/openai/openai-go v0.1.0-beta.10 // indirect
-	github.com/redis/go-redis/v9 v9.7.3 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// canDeleteMessage reports whether the sender of command may delete a message
+// written by authorID: their own messages, or any message for the administrators
+func canDeleteMessage(ctx context.Context, b *bot.Bot, command *models.Message, authorID int64) bool {
+	chatID := command.Chat.ID
+	// Anonymous admins post on behalf of the group
+	if command.SenderChat != nil && command.SenderChat.ID == chatID {
+		return true
+	}
+	if command.From == nil {
+		return false
+	}
+	return command.From.ID == authorID || canConfigureChat(ctx, b, chatID, command.From.ID)
+}
+
+// handlerDeleteMessage marks a message as deleted in the stored history so it is
+// left out of prompts. The message is given by replying to it or by its ID, and
+// is also deleted from the chat when the bot is allowed to. Members can only
+// delete their own messages, administrators any message.
+func handlerDeleteMessage(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	messageID := 0
+	if update.Message.ReplyToMessage != nil {
+		messageID = update.Message.ReplyToMessage.ID
+	} else if parts := strings.Fields(update.Message.Text); len(parts) > 1 {
+		messageID, _ = strconv.Atoi(parts[1])
+	}
+
+	if messageID <= 0 {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   "Usage: reply to a message with /delete, or send /delete <message id>",
+		})
+		return
+	}
+
+	stored, err := chatStorage.GetMessagesByID(chatID, []int{messageID})
+	if err != nil {
+		log.Printf("Error getting message %d in chat %d: %v", messageID, chatID, err)
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   "Failed to delete the message, please try again later.",
+		})
+		return
+	}
+	if len(stored) == 0 {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   fmt.Sprintf("Message %d is not in the chat history.", messageID),
+		})
+		return
+	}
+	if !canDeleteMessage(ctx, b, update.Message, stored[0].FromID) {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   "You can only delete your own messages, only the administrators of this group can delete others.",
+		})
+		return
+	}
+
+	if _, err := chatStorage.UpdateMessage(chatID, messageID, func(message *ChatMessage) {
+		message.Deleted = true
+	}); err != nil {
+		log.Printf("Error deleting message %d in chat %d: %v", messageID, chatID, err)
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   "Failed to delete the message, please try again later.",
+		})
+		return
+	}
+
+	// Best effort, bots can only delete other users' messages as admins
+	if _, err := b.DeleteMessage(ctx, &bot.DeleteMessageParams{ChatID: chatID, MessageID: messageID}); err != nil {
+		log.Printf("Could not delete message %d in chat %d: %v", messageID, chatID, err)
+	}
+
+	// The command itself shouldn't show up in prompts either
+	if _, err := chatStorage.UpdateMessage(chatID, update.Message.ID, func(message *ChatMessage) {
+		message.Deleted = true
+	}); err != nil {
+		log.Printf("Error deleting message %d in chat %d: %v", update.Message.ID, chatID, err)
+	}
+	if _, err := b.DeleteMessage(ctx, &bot.DeleteMessageParams{ChatID: chatID, MessageID: update.Message.ID}); err != nil {
+		log.Printf("Could not delete message %d in chat %d: %v", update.Message.ID, chatID, err)
+	}
+}
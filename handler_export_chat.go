@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// handlerExportChat sends the stored history as a Telegram Desktop compatible result.json,
+// which can be edited and imported back. Admins can export a group from their
+// private chat with /export <group chat id>.
+func handlerExportChat(ctx context.Context, b *bot.Bot, update *models.Update) {
+	// Only process in private chats to prevent spamming group chats
+	if update.Message.Chat.Type != "private" {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: update.Message.Chat.ID,
+			Text:   "This command can only be used in private chats, send /export <group chat id> to the bot to export a group",
+		})
+		return
+	}
+
+	targetID, _, ok := resolveConfigTarget(ctx, b, update.Message)
+	if !ok {
+		return
+	}
+
+	chatID := update.Message.Chat.ID
+	chat := update.Message.Chat
+	if targetID != chatID {
+		info, err := b.GetChat(ctx, &bot.GetChatParams{ChatID: targetID})
+		if err != nil {
+			log.Printf("Error getting chat %d: %v", targetID, err)
+			b.SendMessage(ctx, &bot.SendMessageParams{
+				ChatID: chatID,
+				Text:   "Error exporting chat history",
+			})
+			return
+		}
+		chat = models.Chat{ID: info.ID, Type: info.Type, Title: info.Title, Username: info.Username}
+	}
+
+	chatState, ok := chatStorage.GetChatState(targetID, 0)
+	if !ok || len(chatState.Messages) == 0 {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   "No chat history found.",
+		})
+		return
+	}
+
+	chatExport := NewChatExportFromMessages(chat, chatState.Messages)
+	exportJSON, err := json.MarshalIndent(chatExport, "", " ")
+	if err != nil {
+		log.Printf("Error marshaling chat export: %v", err)
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   "Error exporting chat history",
+		})
+		return
+	}
+
+	_, err = b.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID: chatID,
+		Document: &models.InputFileUpload{
+			Filename: "result.json",
+			Data:     bytes.NewReader(exportJSON),
+		},
+		Caption: "📦 Chat export with " + strconv.Itoa(len(chatExport.Messages)) + " messages",
+	})
+	if err != nil {
+		log.Printf("Error sending chat export: %v", err)
+	}
+}
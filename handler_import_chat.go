@@ -2,19 +2,26 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 )
 
-// handleFileImport processes incoming files and imports chat history
+// telegramMaxDownloadSize is the largest file the Bot API lets bots download
+const telegramMaxDownloadSize = 20 << 20
+
+// handlerImportChat processes incoming chat exports, a result.json or a ZIP of
+// the Telegram Desktop export folder, and imports their history
 func handlerImportChat(ctx context.Context, b *bot.Bot, update *models.Update) {
 	// Only process files in private chats
 	if update.Message.Chat.Type != "private" {
@@ -32,69 +39,265 @@ func handlerImportChat(ctx context.Context, b *bot.Bot, update *models.Update) {
 	log.Printf("received file: %s (ID: %s, MIME: %s, Size: %d bytes) from chat %d",
 		document.FileName, document.FileID, document.MimeType, document.FileSize, userID)
 
-	// Use system temporary directory
-	tmpDir := os.TempDir()
-
-	// Create a unique filename with chatID and timestamp
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	safeFilename := filepath.Clean(document.FileName)
-	filePath := filepath.Join(tmpDir, strconv.FormatInt(userID, 10)+"_"+timestamp+"_"+safeFilename)
+	if document.FileSize > telegramMaxDownloadSize {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: userID,
+			Text:   "This file is too large for bots to download (20 MB at most). Export the chat without media, or send only result.json.",
+		})
+		return
+	}
 
-	// Get file information to download it
-	fileInfo, err := b.GetFile(ctx, &bot.GetFileParams{
-		FileID: document.FileID,
-	})
+	chatExport, err := downloadChatExport(ctx, b, document.FileID, document.FileName)
 	if err != nil {
-		log.Printf("error getting file info: %v", err)
+		log.Printf("error reading file: %v", err)
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: userID,
+			Text:   "Error reading the chat export: " + err.Error(),
+		})
 		return
 	}
 
-	// Get the download link for the file
-	downloadURL := b.FileDownloadLink(fileInfo)
+	// Ask where to import the messages, the export ID isn't the one of the live chat
+	messages := ConvertExportMessages(chatExport.Messages)
+	opts := parseImportOptions(update.Message.Caption)
+	text, keyboard := proposeImport(ctx, b, chatExport, len(messages), document, opts, userID, update.Message.Caption)
+	b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      userID,
+		Text:        text,
+		ReplyMarkup: keyboard,
+	})
+}
 
-	// Download the file using HTTP
-	resp, err := http.Get(downloadURL)
+// downloadChatExport downloads the document with fileID and reads the chat
+// history from it, a result.json or a zipped export folder
+func downloadChatExport(ctx context.Context, b *bot.Bot, fileID, fileName string) (ChatExport, error) {
+	fileInfo, err := b.GetFile(ctx, &bot.GetFileParams{FileID: fileID})
 	if err != nil {
-		log.Printf("error downloading file: %v", err)
-		return
+		return ChatExport{}, fmt.Errorf("failed to get file info: %w", err)
 	}
-	defer resp.Body.Close()
 
+	resp, err := http.Get(b.FileDownloadLink(fileInfo))
+	if err != nil {
+		return ChatExport{}, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("error downloading file: HTTP status code %d", resp.StatusCode)
-		return
+		return ChatExport{}, fmt.Errorf("failed to download file: HTTP status code %d", resp.StatusCode)
 	}
 
-	// Read file data from response
-	fileData, err := io.ReadAll(resp.Body)
+	// Save the file locally with a unique name, the export readers take a path
+	safeFilename := filepath.Base(filepath.Clean(fileName))
+	file, err := os.CreateTemp("", "import-*-"+safeFilename)
 	if err != nil {
-		log.Printf("error reading file data: %v", err)
-		return
+		return ChatExport{}, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, resp.Body)
+	file.Close()
+	if err != nil {
+		return ChatExport{}, fmt.Errorf("failed to save file: %w", err)
 	}
 
-	// Save the file locally
-	if err := os.WriteFile(filePath, fileData, 0644); err != nil {
-		log.Printf("error saving file: %v", err)
-		return
+	switch strings.ToLower(filepath.Ext(safeFilename)) {
+	case ".json":
+		return NewChatExport(file.Name())
+	case ".zip":
+		return NewChatExportFromZip(file.Name())
+	default:
+		return ChatExport{}, fmt.Errorf("not a chat export: %s", safeFilename)
+	}
+}
+
+// importConfirmTimeout is how long a parsed export waits for the target chat to be confirmed
+const importConfirmTimeout = 10 * time.Minute
+
+// importCallbackPrefix prefixes the callback data of the import confirmation:
+// "import:<token>:<chat id>" and "import:<token>:cancel"
+const importCallbackPrefix = "import:"
+
+// PendingImport is an export waiting for its target chat to be confirmed. It is
+// kept in the chat storage, so that any replica can handle the confirmation,
+// and the file is downloaded again from Telegram once confirmed.
+type PendingImport struct {
+	UserID   int64         `json:"user_id"`
+	Name     string        `json:"name"`
+	FileID   string        `json:"file_id"`
+	FileName string        `json:"file_name"`
+	Options  ImportOptions `json:"options"`
+	Targets  []int64       `json:"targets"` // Chats offered to the user
+}
+
+// checkImportTarget verifies that userID may import into the group chatID,
+// returning its title or why it can't be used
+func checkImportTarget(ctx context.Context, b *bot.Bot, chatID, userID int64) (string, error) {
+	if !isChatAllowed(chatID) {
+		return "", fmt.Errorf("the bot is not available in chat %d", chatID)
+	}
+	chat, err := b.GetChat(ctx, &bot.GetChatParams{ChatID: chatID})
+	if err != nil {
+		return "", fmt.Errorf("the bot is not a member of chat %d, add it to the group first", chatID)
+	}
+	if !canConfigureChat(ctx, b, chatID, userID) {
+		return "", fmt.Errorf("you must be an administrator of %s to import into it", chat.Title)
+	}
+	return chat.Title, nil
+}
+
+// proposeImport stores the export until the user picks the chat it belongs to and
+// returns the message asking for it. The live group the export came from is
+// offered when the bot is in it, a negative chat ID in the caption picks
+// another group, and the private chat of the user is always an option.
+func proposeImport(ctx context.Context, b *bot.Bot, chatExport ChatExport, count int, document *models.Document, opts ImportOptions, userID int64, caption string) (string, *models.InlineKeyboardMarkup) {
+	token := bot.RandomString(16)
+	pending := PendingImport{
+		UserID:   userID,
+		Name:     chatExport.Name,
+		FileID:   document.FileID,
+		FileName: document.FileName,
+		Options:  opts,
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Chat export from %s with %d messages.\n", chatExport.Name, count)
+
+	var keyboard [][]models.InlineKeyboardButton
+	addTarget := func(chatID int64, label string) {
+		pending.Targets = append(pending.Targets, chatID)
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: label, CallbackData: fmt.Sprintf("%s%s:%d", importCallbackPrefix, token, chatID)},
+		})
+	}
+
+	target, ok := liveChatID(chatExport)
+	for _, word := range strings.Fields(caption) {
+		if chatID, err := strconv.ParseInt(word, 10, 64); err == nil && chatID < 0 {
+			target, ok = chatID, true
+		}
 	}
+	if ok {
+		if title, err := checkImportTarget(ctx, b, target, userID); err != nil {
+			fmt.Fprintf(&sb, "It can't be linked to its group: %v.\n", err)
+		} else {
+			fmt.Fprintf(&sb, "It belongs to the group %s (%d).\n", title, target)
+			addTarget(target, fmt.Sprintf("Import into %s", title))
+		}
+	}
+	addTarget(userID, "Import into this chat")
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "Cancel", CallbackData: importCallbackPrefix + token + ":cancel"},
+	})
+	sb.WriteString("\nWhere should it be imported?")
+
+	if err := chatStorage.SetPendingImport(token, pending, importConfirmTimeout); err != nil {
+		log.Printf("Error storing pending import: %v", err)
+		return "Error preparing the import, please send the file again.", nil
+	}
+
+	return sb.String(), &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
 
-	// Check if it's a JSON file (potential chat history)
-	if filepath.Ext(safeFilename) != ".json" {
-		log.Printf("not a JSON file, skipping import: %v", filePath)
+// handlerImportCallback imports a pending export into the chat picked by the user
+func handlerImportCallback(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.CallbackQuery
+	answer := &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID}
+	defer func() {
+		if _, err := b.AnswerCallbackQuery(ctx, answer); err != nil {
+			log.Printf("Error answering callback query: %v", err)
+		}
+	}()
+
+	token, choice, _ := strings.Cut(strings.TrimPrefix(query.Data, importCallbackPrefix), ":")
+
+	pending, ok, err := chatStorage.GetPendingImport(token)
+	if err != nil {
+		log.Printf("Error getting pending import: %v", err)
+	}
+	if ok && pending.UserID != query.From.ID {
 		return
 	}
-	chatExport, err := NewChatExport(filePath)
+	if ok {
+		// Only the first confirmation imports, in case of double clicks
+		if ok, err = chatStorage.DeletePendingImport(token); err != nil {
+			log.Printf("Error deleting pending import: %v", err)
+		}
+	}
+	if !ok {
+		answer.Text = "This import has expired, please send the file again."
+		return
+	}
+
+	text := "Import cancelled."
+	if choice != "cancel" {
+		chatID, err := strconv.ParseInt(choice, 10, 64)
+		if err != nil || !slices.Contains(pending.Targets, chatID) {
+			answer.Text = "This chat can't be used."
+			return
+		}
+		text = importChat(ctx, b, chatID, pending)
+	}
+
+	if message := query.Message.Message; message != nil {
+		b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    message.Chat.ID,
+			MessageID: message.ID,
+			Text:      text,
+		})
+	}
+}
+
+// importChat writes the pending export into chatID and describes the outcome
+func importChat(ctx context.Context, b *bot.Bot, chatID int64, pending PendingImport) string {
+	chatExport, err := downloadChatExport(ctx, b, pending.FileID, pending.FileName)
 	if err != nil {
 		log.Printf("error reading file: %v", err)
-		return
+		return "Error reading the chat export: " + err.Error()
 	}
 
-	// Convert and import messages to the chat storage
-	convertedMessages := ConvertExportMessages(chatExport.Messages)
-	chatStorage.ImportChat(chatExport.ID, convertedMessages)
+	opts := pending.Options
+	result, err := chatStorage.ImportChat(chatID, ConvertExportMessages(chatExport.Messages), opts)
+	if err != nil {
+		log.Printf("error importing chat %d: %v", chatID, err)
+		return "Error importing chat export from chat " + pending.Name
+	}
+	log.Printf("Imported chat export from %s into chat %d", pending.Name, chatID)
+	if opts.Replace {
+		dropChatIndex(chatID)
+	} else {
+		invalidateEmbeddings(chatID, result.Changed)
+	}
 
-	b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: userID,
-		Text:   "Successfully imported chat export with " + strconv.Itoa(len(chatExport.Messages)) + " messages from chat " + chatExport.Name,
-	})
+	mode := "Merged"
+	if opts.Replace {
+		mode = "Replaced history with"
+	}
+	text := fmt.Sprintf("%s chat export from chat %s: %d messages added, %d updated, %d skipped.",
+		mode, pending.Name, result.Added, result.Updated, result.Skipped)
+	if opts.ResetPrompt {
+		text += "\nThe character prompt has been reset."
+	}
+	if opts.ResetSummary {
+		text += "\nThe chat overview has been reset."
+	}
+	return text
+}
+
+// parseImportOptions reads the import options from the words in the document caption:
+// "replace" drops the stored history, "reset" clears both the prompt and the summary,
+// "reset-prompt" and "reset-summary" clear only one of them.
+func parseImportOptions(caption string) ImportOptions {
+	var opts ImportOptions
+	for _, word := range strings.Fields(strings.ToLower(caption)) {
+		switch word {
+		case "replace":
+			opts.Replace = true
+		case "reset":
+			opts.ResetPrompt = true
+			opts.ResetSummary = true
+		case "reset-prompt":
+			opts.ResetPrompt = true
+		case "reset-summary":
+			opts.ResetSummary = true
+		}
+	}
+	return opts
 }
@@ -13,24 +13,22 @@ import (
 	"github.com/openai/openai-go"
 )
 
+// handlerInitChat analyzes the chat history and stores the overview used in the
+// reply prompt. Admins can also run it for a group from a private chat.
 func handlerInitChat(ctx context.Context, b *bot.Bot, update *models.Update) {
-	// Only process in private chats to prevent spamming group chats
-	if update.Message.Chat.Type != "private" {
-		b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "This command can only be used in private chats",
-		})
+	targetID, _, ok := resolveConfigTarget(ctx, b, update.Message)
+	if !ok {
 		return
 	}
 
-	// chatID := update.Message.Chat.ID
 	b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: update.Message.Chat.ID,
 		Text:   "Analyzing chat history... This might take a moment.",
 	})
 
 	// Get chat state
-	chatState, ok := chatStorage.GetChatState(update.Message.Chat.ID)
+	budget := llmRegistry.ContextTokens(LLMTaskOverview)
+	chatState, ok := chatStorage.GetChatState(targetID, historyFetchLimit(budget))
 	if !ok || len(chatState.Messages) == 0 {
 		b.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID: update.Message.Chat.ID,
@@ -39,10 +37,10 @@ func handlerInitChat(ctx context.Context, b *bot.Bot, update *models.Update) {
 		return
 	}
 
-	startIndex := max(len(chatState.Messages)-7000, 0)
-
-	// Convert messages to JSON for the prompt
-	messagesJSON, err := json.Marshal(chatState.Messages[startIndex:])
+	// Convert as many recent messages as fit in the model budget to JSON for the prompt
+	messages := fitMessages(chatState.Messages, budget-estimateTokens(promptChatOverview))
+	log.Printf("Using %d of %d messages for the overview (budget %d tokens)", len(messages), len(chatState.Messages), budget)
+	messagesJSON, err := json.Marshal(messages)
 	if err != nil {
 		log.Printf("Error marshaling messages to JSON: %v", err)
 		b.SendMessage(ctx, &bot.SendMessageParams{
@@ -55,27 +53,26 @@ func handlerInitChat(ctx context.Context, b *bot.Bot, update *models.Update) {
 
 	log.Printf("Prompt: %v\n", prompt)
 
-	// Call Gemini API for analysis
-	resp, err := geminiClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+	// Call the overview model for analysis
+	resp, err := llmRegistry.Complete(ctx, LLMTaskOverview, openai.ChatCompletionNewParams{
 		Messages: []openai.ChatCompletionMessageParamUnion{
 			openai.UserMessage(prompt),
 		},
-		Model: "gemini-2.5-pro-preview-03-25", // Adjust model as needed
 	})
 	if err != nil {
-		log.Printf("Error calling Gemini API: %v", err)
+		log.Printf("Error calling overview model: %v", err)
 		b.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID: update.Message.Chat.ID,
-			Text:   "Error analyzing chat: " + err.Error(),
+			Text:   "Error analyzing chat: the AI providers are unavailable right now, please try again later.",
 		})
 		return
 	}
 
 	if len(resp.Choices) == 0 {
-		log.Printf("Error: Empty choices array in Gemini response")
+		log.Printf("Error: Empty choices array in overview response")
 		b.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID: update.Message.Chat.ID,
-			Text:   "Error: Received empty response from Gemini",
+			Text:   "Error: Received empty response from the model",
 		})
 		return
 	}
@@ -84,7 +81,7 @@ func handlerInitChat(ctx context.Context, b *bot.Bot, update *models.Update) {
 	log.Printf("Analysis text: %s", analysisText)
 
 	// Store the summary in the chat state
-	chatStorage.SetSummary(update.Message.Chat.ID, analysisText)
+	chatStorage.SetSummary(targetID, analysisText)
 
 	// Save analysis to a temporary file
 	tmpFile, err := os.CreateTemp("", "analysis-*.txt")
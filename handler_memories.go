@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// memoryTarget is the chat member a memory command is about
+type memoryTarget struct {
+	chatID int64
+	userID int64
+	name   string
+	args   []string // Command arguments left after the chat ID
+}
+
+// resolveMemoryTarget returns whose memories a command is about: the sender,
+// or the sender of the replied message when an administrator replies to it.
+// In private chats the arguments may start with the (negative) ID of a group,
+// to manage the memories of the sender in that group.
+func resolveMemoryTarget(ctx context.Context, b *bot.Bot, message *models.Message) (memoryTarget, bool) {
+	chatID := message.Chat.ID
+	reply := func(text string) {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   text,
+		})
+	}
+
+	if message.From == nil {
+		return memoryTarget{}, false
+	}
+	target := memoryTarget{
+		chatID: chatID,
+		userID: message.From.ID,
+		name:   strings.TrimSpace(message.From.FirstName + " " + message.From.LastName),
+		args:   strings.Fields(commandArgs(message.Text)),
+	}
+
+	if message.Chat.Type == models.ChatTypePrivate {
+		if len(target.args) > 0 {
+			if groupID, err := strconv.ParseInt(target.args[0], 10, 64); err == nil && groupID < 0 {
+				if !isChatAllowed(groupID) {
+					reply("Sorry, this bot is not available in that chat.")
+					return memoryTarget{}, false
+				}
+				target.chatID = groupID
+				target.args = target.args[1:]
+			}
+		}
+		return target, true
+	}
+
+	if replied := message.ReplyToMessage; replied != nil && replied.From != nil && !replied.From.IsBot && replied.From.ID != target.userID {
+		if !canConfigureChat(ctx, b, chatID, target.userID) {
+			reply("Only the administrators of this group can manage the memories of others.")
+			return memoryTarget{}, false
+		}
+		target.userID = replied.From.ID
+		target.name = strings.TrimSpace(replied.From.FirstName + " " + replied.From.LastName)
+	}
+	return target, true
+}
+
+// handlerMemories lists what the character remembers about a chat member
+func handlerMemories(ctx context.Context, b *bot.Bot, update *models.Update) {
+	target, ok := resolveMemoryTarget(ctx, b, update.Message)
+	if !ok {
+		return
+	}
+
+	var text string
+	memories, err := chatStorage.GetMemories(target.chatID)
+	if err != nil {
+		log.Printf("Error getting memories of chat %d: %v", target.chatID, err)
+		text = "Failed to read the memories, please try again later."
+	} else if userMemories := memories.ForUser(target.userID); len(userMemories) == 0 {
+		text = fmt.Sprintf("I don't remember anything about %s yet.", target.name)
+	} else {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "What I remember about %s:\n", target.name)
+		for _, memory := range userMemories {
+			fmt.Fprintf(&sb, "\n#%d %s", memory.ID, memory.Fact)
+		}
+		sb.WriteString("\n\nSend /forget <number> to make me forget one, or /forget all.")
+		text = sb.String()
+	}
+
+	b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: update.Message.Chat.ID,
+		Text:   text,
+	})
+}
+
+// handlerForget drops some or all of the memories about a chat member
+func handlerForget(ctx context.Context, b *bot.Bot, update *models.Update) {
+	target, ok := resolveMemoryTarget(ctx, b, update.Message)
+	if !ok {
+		return
+	}
+
+	reply := func(text string) {
+		b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: update.Message.Chat.ID,
+			Text:   text,
+		})
+	}
+
+	all := slices.Contains(target.args, "all")
+	var ids []int
+	for _, arg := range target.args {
+		if id, err := strconv.Atoi(strings.TrimPrefix(arg, "#")); err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	if !all && len(ids) == 0 {
+		reply("Usage: /forget <number>... or /forget all, the numbers are listed by /memories")
+		return
+	}
+
+	forgotten := 0
+	err := updateMemories(target.chatID, func(m *ChatMemories) {
+		forgotten = m.remove(func(memory UserMemory) bool {
+			return memory.UserID == target.userID && (all || slices.Contains(ids, memory.ID))
+		})
+	})
+	if err != nil {
+		log.Printf("Error forgetting memories of user %d in chat %d: %v", target.userID, target.chatID, err)
+		reply("Failed to forget, please try again later.")
+		return
+	}
+	log.Printf("User %d made the character forget %d memories of user %d in chat %d", update.Message.From.ID, forgotten, target.userID, target.chatID)
+
+	if forgotten == 0 {
+		reply(fmt.Sprintf("There was nothing to forget about %s.", target.name))
+		return
+	}
+	reply(fmt.Sprintf("Forgot %d memories about %s.", forgotten, target.name))
+}
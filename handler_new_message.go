@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -15,35 +16,100 @@ import (
 
 // NewMessageResponse represents the JSON structure returned by the AI model
 type NewMessageResponse struct {
-	ConversationAnalysis string `json:"conversation_analysis"`
-	ResponseMessage      string `json:"response_message"`
+	ConversationAnalysis string         `json:"conversation_analysis"`
+	Messages             []ReplyMessage `json:"messages"`
+	Reaction             *ReplyReaction `json:"reaction,omitempty"`
+	Skip                 bool           `json:"skip,omitempty"`
+
+	// Single message format, still accepted from models ignoring the messages list
+	ResponseMessage string `json:"response_message,omitempty"`
 }
 
+// ReplyMessage is a message to send, optionally as a reply to a stored message
+type ReplyMessage struct {
+	ReplyToID int    `json:"reply_to_id,omitempty"`
+	Text      string `json:"text"`
+	Voice     bool   `json:"voice,omitempty"` // Speak the text as a voice note
+}
+
+// ReplyReaction is an emoji reaction to set on a stored message
+type ReplyReaction struct {
+	MessageID int    `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// Replies returns the non-empty messages to send, in order
+func (r NewMessageResponse) Replies() []ReplyMessage {
+	messages := r.Messages
+	if len(messages) == 0 {
+		messages = []ReplyMessage{{Text: r.ResponseMessage}}
+	}
+
+	replies := make([]ReplyMessage, 0, len(messages))
+	for _, message := range messages {
+		message.Text = strings.TrimSpace(message.Text)
+		if message.Text != "" {
+			replies = append(replies, message)
+		}
+	}
+	return replies
+}
+
+// canReply reports whether the character can answer message: it has text, a
+// caption or an image the vision model describes
+func canReply(message *models.Message) bool {
+	if message.Text != "" || message.Caption != "" {
+		return true
+	}
+	_, _, _, isImage := imageFile(message)
+	return isImage && appConfig.DescribeImages
+}
 
 // handlerNewMessage processes incoming text messages and replies using the AI model
 func handlerNewMessage(ctx context.Context, b *bot.Bot, update *models.Update) {
 	chatID := update.Message.Chat.ID
-	if update.Message.Text == "" {
-		log.Printf("Ignoring non-text message in chat %d", chatID)
+	if !canReply(update.Message) {
+		log.Printf("Ignoring message without text or image in chat %d", chatID)
 		return
 	}
 
-	prompt := buildChatMessages(ctx, b, chatID, 1000)
+	settings := loadChatSettings(chatID)
+	if settings.IsSilent(time.Now()) {
+		log.Printf("Not replying in chat %d during its silence hours", chatID)
+		return
+	}
+	if route, ok := settings.ReplyRoute(); ok {
+		ctx = withLLMRoute(ctx, LLMTaskReply, route)
+	}
+
+	prompt := buildChatMessages(ctx, b, chatID, llmRegistry.ContextTokens(LLMTaskReply), settings)
 
 	req := openai.ChatCompletionNewParams{
 		Messages: []openai.ChatCompletionMessageParamUnion{
 			openai.UserMessage(prompt),
 		},
-		Model:           "grok-3-mini-beta",
-		ReasoningEffort: "low",
 		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
 			OfJSONObject: &shared.ResponseFormatJSONObjectParam{},
 		},
 	}
 
-	resp, err := grokClient.Chat.Completions.New(ctx, req)
+	// Show the character typing while the reply is generated and delayed
+	stopTyping := startChatAction(ctx, b, chatID, models.ChatActionTyping)
+	defer stopTyping()
+
+	if appConfig.StreamReplies {
+		streamChatReply(ctx, b, chatID, req)
+		return
+	}
+
+	started := time.Now()
+	resp, err := llmRegistry.Complete(ctx, LLMTaskReply, req)
+	if ctx.Err() != nil {
+		log.Printf("Reply in chat %d superseded by newer messages", chatID)
+		return
+	}
 	if err != nil {
-		log.Printf("Error calling llm model")
+		log.Printf("Error calling llm model: %v", err)
 		return
 	}
 	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
@@ -51,25 +117,101 @@ func handlerNewMessage(ctx context.Context, b *bot.Bot, update *models.Update) {
 		return
 	}
 
-	var result NewMessageResponse
 	raw := resp.Choices[0].Message.Content
-	if err := json.Unmarshal([]byte(raw), &result); err != nil {
-		fallback := fmt.Sprintf("Sorry, I had trouble formatting my response. Raw output: %s", raw)
-		if len(fallback) > 4000 {
-			fallback = fallback[:4000] + "..."
-		}
-		sendChatMessage(ctx, b, chatID, fallback)
+	result, err := parseReply(raw)
+	if err != nil {
+		sendChatMessage(ctx, b, chatID, replyFormatFallback(raw), 0)
+		return
+	}
+
+	handleReply(ctx, b, chatID, result, time.Since(started))
+}
+
+// handleReply sets the reaction chosen by the model and sends its messages.
+// A response with neither means the character stays silent.
+func handleReply(ctx context.Context, b *bot.Bot, chatID int64, result NewMessageResponse, elapsed time.Duration) {
+	if result.Skip {
+		log.Printf("Model chose to skip replying in chat %d", chatID)
 		return
 	}
 
-	if msg := strings.TrimSpace(result.ResponseMessage); msg != "" {
-		sendChatMessage(ctx, b, chatID, msg)
+	replies := result.Replies()
+	if result.Reaction != nil {
+		setChatReaction(ctx, b, chatID, *result.Reaction)
+	} else if len(replies) == 0 {
+		log.Printf("Staying silent in chat %d", chatID)
 	}
+
+	sendReplies(ctx, b, chatID, replies, elapsed, true)
 }
 
-// buildChatMessages constructs the prompt using stored chat history and templates
-func buildChatMessages(ctx context.Context, b *bot.Bot, chatID int64, limit int) string {
-	state, ok := chatStorage.GetChatState(chatID)
+// setChatReaction reacts to a message and records the bot's reaction in chat history
+func setChatReaction(ctx context.Context, b *bot.Bot, chatID int64, reaction ReplyReaction) {
+	emoji := strings.TrimSpace(reaction.Emoji)
+	if reaction.MessageID == 0 || emoji == "" {
+		return
+	}
+
+	_, err := b.SetMessageReaction(ctx, &bot.SetMessageReactionParams{
+		ChatID:    chatID,
+		MessageID: reaction.MessageID,
+		Reaction: []models.ReactionType{{
+			Type:              models.ReactionTypeTypeEmoji,
+			ReactionTypeEmoji: &models.ReactionTypeEmoji{Type: models.ReactionTypeTypeEmoji, Emoji: emoji},
+		}},
+	})
+	if err != nil {
+		log.Printf("Error setting reaction %s on message %d: %v", emoji, reaction.MessageID, err)
+		return
+	}
+
+	_, err = chatStorage.UpdateMessage(chatID, reaction.MessageID, func(message *ChatMessage) {
+		message.SetBotReaction(emoji)
+	})
+	if err != nil {
+		log.Printf("Error storing reaction: %v", err)
+	}
+}
+
+// sendReplies sends replies in order, waiting the human-like typing delay before each
+// when delay is set. elapsed is the time already spent generating them, it counts
+// towards the first delay. Replies the model asked to speak are sent as voice notes
+// when the chat allows it.
+func sendReplies(ctx context.Context, b *bot.Bot, chatID int64, replies []ReplyMessage, elapsed time.Duration, delay bool) {
+	canSpeak := len(replies) > 0 && loadChatSettings(chatID).CanSpeak()
+	for _, reply := range replies {
+		if delay && !waitReplyDelay(ctx, chatID, reply.Text, elapsed) {
+			return
+		}
+		elapsed = 0
+		if reply.Voice && canSpeak {
+			sendChatVoice(ctx, b, chatID, reply.Text, reply.ReplyToID)
+		} else {
+			sendChatMessage(ctx, b, chatID, reply.Text, reply.ReplyToID)
+		}
+	}
+}
+
+// parseReply decodes the JSON response of the reply model
+func parseReply(raw string) (NewMessageResponse, error) {
+	var result NewMessageResponse
+	err := json.Unmarshal([]byte(raw), &result)
+	return result, err
+}
+
+// replyFormatFallback is sent when the model response isn't valid JSON
+func replyFormatFallback(raw string) string {
+	fallback := fmt.Sprintf("Sorry, I had trouble formatting my response. Raw output: %s", raw)
+	if len(fallback) > 4000 {
+		fallback = fallback[:4000] + "..."
+	}
+	return fallback
+}
+
+// buildChatMessages constructs the prompt using stored chat history and templates,
+// filling it with as much recent history as fits in budget tokens and the chat's history window
+func buildChatMessages(ctx context.Context, b *bot.Bot, chatID int64, budget int, settings ChatSettings) string {
+	state, ok := chatStorage.GetChatState(chatID, settings.HistoryLimit(historyFetchLimit(budget)))
 	if !ok {
 		log.Printf("Chat state not found for %d", chatID)
 		return `{"error":"state missing","response_preparation":"","response_message":""}`
@@ -78,6 +220,8 @@ func buildChatMessages(ctx context.Context, b *bot.Bot, chatID int64, limit int)
 	prompt := promptChatMessage
 	prompt = strings.Replace(prompt, "{{PROMPT}}", state.Prompt, 1)
 	prompt = strings.Replace(prompt, "{{OVERVIEW}}", state.Summary, 1)
+	prompt = strings.Replace(prompt, "{{LANGUAGE}}", settings.LanguageInstruction(), 1)
+	prompt = strings.Replace(prompt, "{{VOICE}}", settings.VoiceInstruction(), 1)
 
 	me, err := b.GetMe(ctx)
 	botName := "@Bot"
@@ -88,18 +232,41 @@ func buildChatMessages(ctx context.Context, b *bot.Bot, chatID int64, limit int)
 	}
 	prompt = strings.ReplaceAll(prompt, "{{BOT_NAME}}", botName)
 
-	total := len(state.Messages)
-	start := max(total-limit, 0)
-	last := max(start, total-20)
+	// Memories of the people in the recent messages
+	recent := state.Messages[max(len(state.Messages)-20, 0):]
+	prompt = strings.Replace(prompt, "{{MEMORIES}}", speakerMemories(chatID, recent), 1)
+
+	// Whatever the template, persona and overview leave is used for the history
+	messages := fitMessages(state.Messages, budget-estimateTokens(prompt))
+
+	// Older messages related to the conversation, the history makes room for them
+	related := "[]"
+	if len(messages) > 0 {
+		if retrieved := retrieveMessages(ctx, chatID, messages, messages[0].ID); len(retrieved) > 0 {
+			if data, err := json.Marshal(retrieved); err == nil {
+				related = string(data)
+				log.Printf("Retrieved %d older messages for chat %d", len(retrieved), chatID)
+			} else {
+				log.Printf("Error marshaling retrieved messages: %v", err)
+			}
+		}
+	}
+	prompt = strings.Replace(prompt, "{{RELATED_MESSAGES}}", related, 1)
+	if related != "[]" {
+		messages = fitMessages(state.Messages, budget-estimateTokens(prompt))
+	}
+	log.Printf("Using %d of %d messages for chat %d (budget %d tokens)", len(messages), len(state.Messages), chatID, budget)
+
+	last := max(len(messages)-20, 0)
 
-	if data, err := json.Marshal(state.Messages[last:]); err == nil {
+	if data, err := json.Marshal(messages[last:]); err == nil {
 		prompt = strings.Replace(prompt, "{{LAST_MESSAGES}}", string(data), 1)
 	} else {
 		log.Printf("Error marshaling last messages: %v", err)
 		prompt = strings.Replace(prompt, "{{LAST_MESSAGES}}", "[]", 1)
 	}
 
-	if data, err := json.Marshal(state.Messages[start:last]); err == nil {
+	if data, err := json.Marshal(messages[:last]); err == nil {
 		prompt = strings.Replace(prompt, "{{CHAT_HISTORY}}", string(data), 1)
 	} else {
 		log.Printf("Error marshaling history messages: %v", err)
@@ -110,9 +277,25 @@ func buildChatMessages(ctx context.Context, b *bot.Bot, chatID int64, limit int)
 	return prompt
 }
 
-// sendChatMessage sends a message and stores it in chat history
-func sendChatMessage(ctx context.Context, b *bot.Bot, chatID int64, text string) {
-	params := &bot.SendMessageParams{ChatID: chatID, Text: text}
+// replyParameters makes a message a reply to replyToID, when set. The message is
+// still sent if the target no longer exists.
+func replyParameters(replyToID int) *models.ReplyParameters {
+	if replyToID == 0 {
+		return nil
+	}
+	return &models.ReplyParameters{
+		MessageID:                replyToID,
+		AllowSendingWithoutReply: true,
+	}
+}
+
+// sendChatMessage sends a message, as a reply to replyToID when not zero, and stores it in chat history
+func sendChatMessage(ctx context.Context, b *bot.Bot, chatID int64, text string, replyToID int) {
+	params := &bot.SendMessageParams{
+		ChatID:          chatID,
+		Text:            text,
+		ReplyParameters: replyParameters(replyToID),
+	}
 	if msg, err := b.SendMessage(ctx, params); err != nil {
 		log.Printf("Error sending message: %v", err)
 	} else {
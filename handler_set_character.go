@@ -2,37 +2,29 @@ package main
 
 import (
 	"context"
-	"strings"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 )
 
+// handlerSetCharacter sets the character prompt of the chat, or of a group the
+// sender administers when its ID comes first
 func handlerSetCharacter(ctx context.Context, b *bot.Bot, update *models.Update) {
-	if update.Message.Chat.Type != "private" {
+	targetID, args, ok := resolveConfigTarget(ctx, b, update.Message)
+	if !ok {
 		return
 	}
 
-	commandFullText := update.Message.Text
-	commandArgs := ""
-
-	parts := strings.Fields(commandFullText) // Split by whitespace
-	if len(parts) > 1 {
-		commandPart := parts[0]
-		commandEndIndex := len(commandPart)
-		commandArgs = strings.TrimSpace(commandFullText[commandEndIndex:])
-	}
-
 	// No command args provided
-	if commandArgs == "" {
+	if args == "" {
 		b.SendMessage(ctx, &bot.SendMessageParams{
 			ChatID: update.Message.Chat.ID,
-			Text:   "Usage: /config <character description>\nPlease provide a character description to set as the prompt.",
+			Text:   "Usage: /config [group chat id] <character description>\nPlease provide a character description to set as the prompt.",
 		})
 		return
 	}
 
-	chatStorage.SetPrompt(update.Message.Chat.ID, commandArgs)
+	chatStorage.SetPrompt(targetID, args)
 
 	b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: update.Message.Chat.ID,
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// settingsCallbackPrefix prefixes the callback data of the /settings keyboard:
+// "settings:<chat id>:menu", "settings:<chat id>:open:<key>" and
+// "settings:<chat id>:set:<key>:<option>"
+const settingsCallbackPrefix = "settings:"
+
+// settingOption is a value offered for a setting
+type settingOption struct {
+	label string
+	apply func(*ChatSettings)
+}
+
+// chatSetting is a setting editable with /settings. The first option of each
+// setting restores the default.
+type chatSetting struct {
+	key     string
+	name    string
+	value   func(chatID int64, s ChatSettings) string
+	options func() []settingOption
+}
+
+var chatSettingsMenu = []chatSetting{
+	{
+		key:  "probability",
+		name: "Reply probability",
+		value: func(chatID int64, s ChatSettings) string {
+			if s.ReplyProbability != nil {
+				return fmt.Sprintf("%.0f%%", *s.ReplyProbability*100)
+			}
+			if appConfig.GroupReplyMode == GroupReplyModeProbability {
+				return fmt.Sprintf("default (%.0f%%)", appConfig.GroupReplyProbability*100)
+			}
+			return fmt.Sprintf("default (%s mode)", appConfig.GroupReplyMode)
+		},
+		options: func() []settingOption {
+			options := []settingOption{{"Default", func(s *ChatSettings) { s.ReplyProbability = nil }}}
+			for _, p := range []float64{0, 0.1, 0.25, 0.5, 1} {
+				options = append(options, settingOption{fmt.Sprintf("%.0f%%", p*100), func(s *ChatSettings) { s.ReplyProbability = &p }})
+			}
+			return options
+		},
+	},
+	{
+		key:  "delay",
+		name: "Reply delay",
+		value: func(chatID int64, s ChatSettings) string {
+			value := "off"
+			if delay := s.ReplyDelay(chatID); delay > 0 {
+				value = delay.String() + " per character"
+			}
+			if s.ReplyDelayPerChar == nil {
+				return "default (" + value + ")"
+			}
+			return value
+		},
+		options: func() []settingOption {
+			options := []settingOption{{"Default", func(s *ChatSettings) { s.ReplyDelayPerChar = nil }}}
+			for _, d := range []time.Duration{0, 30 * time.Millisecond, 60 * time.Millisecond, 100 * time.Millisecond} {
+				label := "Off"
+				if d > 0 {
+					label = d.String() + "/char"
+				}
+				options = append(options, settingOption{label, func(s *ChatSettings) { s.ReplyDelayPerChar = &d }})
+			}
+			return options
+		},
+	},
+	{
+		key:  "model",
+		name: "Model",
+		value: func(chatID int64, s ChatSettings) string {
+			if route, ok := s.ReplyRoute(); ok {
+				return route.Route()
+			}
+			return "default (" + appConfig.LLMTasks[LLMTaskReply].Route() + ")"
+		},
+		options: func() []settingOption {
+			options := []settingOption{{"Default", func(s *ChatSettings) { s.Model = "" }}}
+			for _, route := range appConfig.LLMReplyModels {
+				options = append(options, settingOption{route.Route(), func(s *ChatSettings) { s.Model = route.Route() }})
+			}
+			return options
+		},
+	},
+	{
+		key:  "history",
+		name: "History window",
+		value: func(chatID int64, s ChatSettings) string {
+			if s.HistoryMessages > 0 {
+				return fmt.Sprintf("%d messages", s.HistoryMessages)
+			}
+			return "default (as much as fits)"
+		},
+		options: func() []settingOption {
+			options := []settingOption{{"Default", func(s *ChatSettings) { s.HistoryMessages = 0 }}}
+			for _, n := range []int{20, 50, 100, 200} {
+				options = append(options, settingOption{strconv.Itoa(n), func(s *ChatSettings) { s.HistoryMessages = n }})
+			}
+			return options
+		},
+	},
+	{
+		key:  "language",
+		name: "Language",
+		value: func(chatID int64, s ChatSettings) string {
+			if s.Language != "" {
+				return s.Language
+			}
+			return "default (same as the chat)"
+		},
+		options: func() []settingOption {
+			options := []settingOption{{"Default", func(s *ChatSettings) { s.Language = "" }}}
+			for _, language := range []string{"English", "Italian", "Spanish", "French", "German", "Portuguese", "Russian"} {
+				options = append(options, settingOption{language, func(s *ChatSettings) { s.Language = language }})
+			}
+			return options
+		},
+	},
+	{
+		key:  "voice",
+		name: "Voice replies",
+		value: func(chatID int64, s ChatSettings) string {
+			switch {
+			case speaker == nil:
+				return "unavailable"
+			case s.VoiceReplies == nil:
+				return "default (on)"
+			case *s.VoiceReplies:
+				return "on"
+			default:
+				return "off"
+			}
+		},
+		options: func() []settingOption {
+			options := []settingOption{{"Default", func(s *ChatSettings) { s.VoiceReplies = nil }}}
+			for _, enabled := range []bool{true, false} {
+				label := "Off"
+				if enabled {
+					label = "On"
+				}
+				options = append(options, settingOption{label, func(s *ChatSettings) { s.VoiceReplies = &enabled }})
+			}
+			return options
+		},
+	},
+	{
+		key:  "silence",
+		name: "Silence hours",
+		value: func(chatID int64, s ChatSettings) string {
+			if s.SilenceHours != nil {
+				return s.SilenceHours.String()
+			}
+			return "off"
+		},
+		options: func() []settingOption {
+			options := []settingOption{{"Off", func(s *ChatSettings) { s.SilenceHours = nil }}}
+			for _, hours := range []SilenceHours{{22, 8}, {23, 7}, {0, 8}, {1, 9}} {
+				options = append(options, settingOption{hours.String(), func(s *ChatSettings) { s.SilenceHours = &hours }})
+			}
+			return options
+		},
+	},
+}
+
+// findChatSetting returns the setting with key
+func findChatSetting(key string) (chatSetting, bool) {
+	for _, setting := range chatSettingsMenu {
+		if setting.key == key {
+			return setting, true
+		}
+	}
+	return chatSetting{}, false
+}
+
+// settingsCallbackData builds the callback data of an action on the settings of chatID
+func settingsCallbackData(chatID int64, action string) string {
+	return fmt.Sprintf("%s%d:%s", settingsCallbackPrefix, chatID, action)
+}
+
+// settingsMenu renders the current settings of chatID with a button for each of
+// them, for a message sent in shownIn
+func settingsMenu(chatID, shownIn int64) (string, *models.InlineKeyboardMarkup) {
+	settings := loadChatSettings(chatID)
+
+	var sb strings.Builder
+	if chatID == shownIn {
+		sb.WriteString("Settings of this chat:\n")
+	} else {
+		fmt.Fprintf(&sb, "Settings of chat %d:\n", chatID)
+	}
+	keyboard := make([][]models.InlineKeyboardButton, 0, len(chatSettingsMenu))
+	for _, setting := range chatSettingsMenu {
+		fmt.Fprintf(&sb, "\n%s: %s", setting.name, setting.value(chatID, settings))
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: setting.name, CallbackData: settingsCallbackData(chatID, "open:"+setting.key)},
+		})
+	}
+	return sb.String(), &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+// settingOptionsMenu renders the options of setting, two per row, followed by a back button
+func settingOptionsMenu(chatID int64, setting chatSetting) (string, *models.InlineKeyboardMarkup) {
+	text := fmt.Sprintf("%s: %s\n\nChoose a new value:", setting.name, setting.value(chatID, loadChatSettings(chatID)))
+
+	var keyboard [][]models.InlineKeyboardButton
+	for i, option := range setting.options() {
+		button := models.InlineKeyboardButton{
+			Text:         option.label,
+			CallbackData: settingsCallbackData(chatID, fmt.Sprintf("set:%s:%d", setting.key, i)),
+		}
+		if i%2 == 0 {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{button})
+		} else {
+			keyboard[len(keyboard)-1] = append(keyboard[len(keyboard)-1], button)
+		}
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "« Back", CallbackData: settingsCallbackData(chatID, "menu")},
+	})
+	return text, &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+// handlerSettings shows the settings of the chat, or of a group the sender
+// administers when its ID is given, with buttons to change them
+func handlerSettings(ctx context.Context, b *bot.Bot, update *models.Update) {
+	targetID, _, ok := resolveConfigTarget(ctx, b, update.Message)
+	if !ok {
+		return
+	}
+
+	chatID := update.Message.Chat.ID
+	text, keyboard := settingsMenu(targetID, chatID)
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      chatID,
+		Text:        text,
+		ReplyMarkup: keyboard,
+	}); err != nil {
+		log.Printf("Error sending settings: %v", err)
+	}
+}
+
+// handlerSettingsCallback handles the buttons of the /settings message
+func handlerSettingsCallback(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.CallbackQuery
+	answer := &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID}
+	defer func() {
+		if _, err := b.AnswerCallbackQuery(ctx, answer); err != nil {
+			log.Printf("Error answering callback query: %v", err)
+		}
+	}()
+
+	message := query.Message.Message
+	if message == nil {
+		answer.Text = "This message is too old, send /settings again."
+		return
+	}
+	chatID := message.Chat.ID
+
+	// The buttons are visible to the whole group, check who pressed them
+	parts := strings.Split(strings.TrimPrefix(query.Data, settingsCallbackPrefix), ":")
+	targetID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) < 2 {
+		answer.Text = "This option is no longer available."
+		return
+	}
+	if !canConfigureChat(ctx, b, targetID, query.From.ID) {
+		answer.Text = "Only the administrators of the chat can change its settings."
+		return
+	}
+	parts = parts[1:]
+
+	var text string
+	var keyboard *models.InlineKeyboardMarkup
+	switch {
+	case parts[0] == "menu":
+		text, keyboard = settingsMenu(targetID, chatID)
+	case parts[0] == "open" && len(parts) == 2:
+		setting, ok := findChatSetting(parts[1])
+		if !ok {
+			return
+		}
+		text, keyboard = settingOptionsMenu(targetID, setting)
+	case parts[0] == "set" && len(parts) == 3:
+		setting, ok := findChatSetting(parts[1])
+		if !ok {
+			answer.Text = "This option is no longer available."
+			return
+		}
+		options := setting.options()
+		i, err := strconv.Atoi(parts[2])
+		if err != nil || i < 0 || i >= len(options) {
+			answer.Text = "This option is no longer available."
+			return
+		}
+
+		settings := loadChatSettings(targetID)
+		options[i].apply(&settings)
+		if err := chatStorage.SetSettings(targetID, settings); err != nil {
+			log.Printf("Error saving settings of chat %d: %v", targetID, err)
+			answer.Text = "Failed to save the setting, please try again later."
+			return
+		}
+		log.Printf("User %d set %s of chat %d to %s", query.From.ID, setting.key, targetID, options[i].label)
+		answer.Text = setting.name + " updated"
+		text, keyboard = settingsMenu(targetID, chatID)
+	default:
+		return
+	}
+
+	if _, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      chatID,
+		MessageID:   message.ID,
+		Text:        text,
+		ReplyMarkup: keyboard,
+	}); err != nil {
+		log.Printf("Error editing settings message: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/openai/openai-go/shared"
+)
+
+// LLMRegistry holds a client for every configured provider and routes each
+// task to its provider, model and parameters.
+type LLMRegistry struct {
+	clients map[string]openai.Client
+	tasks   map[string]LLMTaskConfig
+	retry   LLMRetryConfig
+}
+
+func NewLLMRegistry(config Config) *LLMRegistry {
+	clients := make(map[string]openai.Client, len(config.LLMProviders))
+	for name, provider := range config.LLMProviders {
+		clients[name] = openai.NewClient(
+			option.WithBaseURL(provider.BaseURL),
+			option.WithAPIKey(provider.APIKey),
+			// Retries are handled by the registry so they can fall back to other providers
+			option.WithMaxRetries(0),
+		)
+	}
+
+	return &LLMRegistry{
+		clients: clients,
+		tasks:   config.LLMTasks,
+		retry:   config.LLMRetry,
+	}
+}
+
+// llmRouteKey is the context key of a task route override
+type llmRouteKey struct {
+	task string
+}
+
+// withLLMRoute makes the calls of task made with ctx try route first, the
+// configured routes of the task are kept as fallbacks
+func withLLMRoute(ctx context.Context, task string, route LLMTaskConfig) context.Context {
+	return context.WithValue(ctx, llmRouteKey{task}, route)
+}
+
+// routes returns the task route followed by its fallbacks, after the route
+// override of ctx if any
+func (r *LLMRegistry) routes(ctx context.Context, task string) ([]LLMTaskConfig, error) {
+	taskConfig, ok := r.tasks[task]
+	if !ok {
+		return nil, fmt.Errorf("no LLM route configured for task %s", task)
+	}
+	routes := append([]LLMTaskConfig{taskConfig}, taskConfig.Fallbacks...)
+
+	override, ok := ctx.Value(llmRouteKey{task}).(LLMTaskConfig)
+	if !ok {
+		return routes, nil
+	}
+	result := []LLMTaskConfig{override}
+	for _, route := range routes {
+		if route.Route() != override.Route() {
+			result = append(result, route)
+		}
+	}
+	return result, nil
+}
+
+// ContextTokens returns the prompt budget of task
+func (r *LLMRegistry) ContextTokens(task string) int {
+	if taskConfig, ok := r.tasks[task]; ok && taskConfig.ContextTokens > 0 {
+		return taskConfig.ContextTokens
+	}
+	return defaultContextTokens
+}
+
+// isTransientLLMError reports whether err is worth retrying on the same provider:
+// rate limits, server errors and timeouts.
+func isTransientLLMError(err error) bool {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests ||
+			apiErr.StatusCode == http.StatusRequestTimeout ||
+			apiErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// applyTaskConfig sets the model and the configured parameters on params
+func applyTaskConfig(params *openai.ChatCompletionNewParams, taskConfig LLMTaskConfig) {
+	params.Model = taskConfig.Model
+	if taskConfig.ReasoningEffort != "" {
+		params.ReasoningEffort = shared.ReasoningEffort(taskConfig.ReasoningEffort)
+	}
+	if taskConfig.Temperature >= 0 {
+		params.Temperature = openai.Float(taskConfig.Temperature)
+	}
+	if taskConfig.MaxTokens > 0 {
+		params.MaxTokens = openai.Int(taskConfig.MaxTokens)
+	}
+}
+
+// withTimeout bounds a single attempt by the per-attempt timeout
+func (r *LLMRegistry) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.retry.Timeout > 0 {
+		return context.WithTimeout(ctx, r.retry.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// client returns the client of the route provider
+func (r *LLMRegistry) client(route LLMTaskConfig) (openai.Client, error) {
+	client, ok := r.clients[route.Provider]
+	if !ok {
+		return openai.Client{}, fmt.Errorf("unknown LLM provider %s", route.Provider)
+	}
+	return client, nil
+}
+
+// streamInterruptedError marks a stream that failed after delivering content,
+// which can't be retried or replaced by a fallback without duplicating output
+type streamInterruptedError struct {
+	err error
+}
+
+func (e *streamInterruptedError) Error() string {
+	return "stream interrupted: " + e.err.Error()
+}
+
+func (e *streamInterruptedError) Unwrap() error {
+	return e.err
+}
+
+// run calls attempt for each route of task until one succeeds. Transient errors
+// are retried with exponential backoff, then the fallback routes are tried in order.
+func (r *LLMRegistry) run(ctx context.Context, task string, attempt func(ctx context.Context, route LLMTaskConfig) error) error {
+	routes, err := r.routes(ctx, task)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, route := range routes {
+		backoff := r.retry.InitialBackoff
+		for n := 1; n <= r.retry.MaxAttempts; n++ {
+			attemptCtx, cancel := r.withTimeout(ctx)
+			err := attempt(attemptCtx, route)
+			cancel()
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+
+			// The caller gave up, neither retries nor fallbacks can help
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log.Printf("LLM task %s failed on %s:%s (attempt %d/%d): %v",
+				task, route.Provider, route.Model, n, r.retry.MaxAttempts, err)
+
+			var interrupted *streamInterruptedError
+			if errors.As(err, &interrupted) {
+				return err
+			}
+			if !isTransientLLMError(err) || n == r.retry.MaxAttempts {
+				break
+			}
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff = min(backoff*2, r.retry.MaxBackoff)
+		}
+	}
+
+	return fmt.Errorf("all LLM routes failed for task %s: %w", task, lastErr)
+}
+
+// Complete runs a chat completion for task. The caller provides the messages and
+// response format, the model and its parameters come from the task route.
+func (r *LLMRegistry) Complete(ctx context.Context, task string, params openai.ChatCompletionNewParams) (*openai.ChatCompletion, error) {
+	var resp *openai.ChatCompletion
+	err := r.run(ctx, task, func(ctx context.Context, route LLMTaskConfig) error {
+		client, err := r.client(route)
+		if err != nil {
+			return err
+		}
+		applyTaskConfig(&params, route)
+		resp, err = client.Chat.Completions.New(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+// Stream runs a streaming chat completion for task and returns the whole content.
+// onContent is called with the content received so far after every chunk.
+// Failures before the first chunk are retried and fall back like Complete.
+func (r *LLMRegistry) Stream(ctx context.Context, task string, params openai.ChatCompletionNewParams, onContent func(content string)) (string, error) {
+	var content strings.Builder
+	err := r.run(ctx, task, func(ctx context.Context, route LLMTaskConfig) error {
+		client, err := r.client(route)
+		if err != nil {
+			return err
+		}
+		applyTaskConfig(&params, route)
+
+		stream := client.Chat.Completions.NewStreaming(ctx, params)
+		defer stream.Close()
+
+		content.Reset()
+		for stream.Next() {
+			chunk := stream.Current()
+			if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+				continue
+			}
+			content.WriteString(chunk.Choices[0].Delta.Content)
+			onContent(content.String())
+		}
+
+		if err := stream.Err(); err != nil {
+			if content.Len() > 0 {
+				return &streamInterruptedError{err: err}
+			}
+			return err
+		}
+		return nil
+	})
+	return content.String(), err
+}
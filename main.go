@@ -9,18 +9,19 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
 )
 
 var (
-	chatStorage  *ChatStorage
-	grokClient   openai.Client
-	geminiClient openai.Client
-	appConfig    Config
+	chatStorage ChatStore
+	llmRegistry *LLMRegistry
+	appConfig   Config
+	transcriber Transcriber // nil when voice transcription is disabled
+	speaker     Speaker     // nil when voice replies are disabled
+	embedder    *Embedder   // nil when the chat archive search is disabled
 )
 
 // Prompts
@@ -29,6 +30,12 @@ var (
 	promptChatMessage string
 	//go:embed prompts/chat_overview.txt
 	promptChatOverview string
+	//go:embed prompts/extract_memories.txt
+	promptExtractMemories string
+	//go:embed prompts/should_reply.txt
+	promptShouldReply string
+	//go:embed prompts/describe_image.txt
+	promptDescribeImage string
 )
 
 func main() {
@@ -44,22 +51,32 @@ func main() {
 	}
 
 	// Initialize ai clients
-	grokClient = openai.NewClient(
-		option.WithBaseURL("https://api.x.ai/v1"),
-		option.WithAPIKey(appConfig.GrokApiKey),
-	)
-
-	geminiClient = openai.NewClient(
-		option.WithBaseURL("https://generativelanguage.googleapis.com/v1beta/openai/"),
-		option.WithAPIKey(appConfig.GeminiApiKey),
-	)
-
-	// Initialize Redis-based chat storage
-	chatStorage = NewChatStorage(appConfig)
+	llmRegistry = NewLLMRegistry(appConfig)
+	transcriber = NewTranscriber(appConfig)
+	speaker = NewSpeaker(appConfig)
+	embedder = NewEmbedder(appConfig)
+
+	// Initialize chat storage
+	chatStorage, err = NewChatStore(appConfig)
+	if err != nil {
+		log.Fatalf("failed to create chat storage: %v", err)
+	}
 	if err := chatStorage.Ping(); err != nil {
-		log.Fatalf("redis connection failed: %v", err)
+		log.Fatalf("storage connection failed: %v", err)
+	}
+	log.Printf("Using %s chat storage", appConfig.StorageBackend)
+
+	if redisStorage, ok := chatStorage.(*ChatStorage); ok {
+		if migrated, err := redisStorage.MigrateLegacyChats(); err != nil {
+			log.Fatalf("failed to migrate legacy chats: %v", err)
+		} else if migrated > 0 {
+			log.Printf("Migrated %d legacy chats", migrated)
+		}
 	}
 
+	// Per-chat work queue
+	chatQueue = newChatWorkQueue(appConfig.ChatQueueSize)
+
 	// Bot Init
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
@@ -68,13 +85,15 @@ func main() {
 			return
 		}
 		if err := chatStorage.Close(); err != nil {
-			log.Printf("error closing Redis connection: %v", err)
+			log.Printf("error closing chat storage: %v", err)
 		}
 	}()
 
 	opts := []bot.Option{
-		bot.WithMiddlewares(allowListMiddleware, storeMessageMiddleware, randomReplyMiddleware),
-		bot.WithDefaultHandler(handlerNewMessage),
+		// Updates are dispatched in arrival order, serializeChatMiddleware hands them to the chat workers
+		bot.WithNotAsyncHandlers(),
+		bot.WithMiddlewares(serializeChatMiddleware, allowListMiddleware, storeMessageMiddleware, transcribeVoiceMiddleware, describeImageMiddleware, collectMemoriesMiddleware, randomReplyMiddleware),
+		bot.WithDefaultHandler(debounceHandler(handlerNewMessage)),
 	}
 
 	b, err := bot.New(appConfig.TelegramBotToken, opts...)
@@ -82,42 +101,102 @@ func main() {
 		log.Fatalf("failed to create bot instance: %v", err)
 	}
 
-	b.RegisterHandler(bot.HandlerTypeMessageText, "config", bot.MatchTypeCommand, handlerSetCharacter)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "init", bot.MatchTypeCommand, handlerInitChat)
+	// Commands sent in groups are addressed as /command@bot
+	me, err := b.GetMe(ctx)
+	if err != nil {
+		log.Fatalf("failed to get bot info: %v", err)
+	}
 
-	b.RegisterHandlerMatchFunc(matchJsonFiles, handlerImportChat)
+	b.RegisterHandlerMatchFunc(matchCommand("config", me.Username), handlerSetCharacter)
+	b.RegisterHandlerMatchFunc(matchCommand("init", me.Username), handlerInitChat)
+	b.RegisterHandlerMatchFunc(matchCommand("export", me.Username), handlerExportChat)
+	b.RegisterHandlerMatchFunc(matchCommand("delete", me.Username), handlerDeleteMessage)
+	b.RegisterHandlerMatchFunc(matchCommand("settings", me.Username), handlerSettings)
+	b.RegisterHandlerMatchFunc(matchCommand("memories", me.Username), handlerMemories)
+	b.RegisterHandlerMatchFunc(matchCommand("forget", me.Username), handlerForget)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, settingsCallbackPrefix, bot.MatchTypePrefix, handlerSettingsCallback)
+
+	b.RegisterHandlerMatchFunc(matchImportFiles, handlerImportChat)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, importCallbackPrefix, bot.MatchTypePrefix, handlerImportCallback)
+
+	// HTTP server for the Fly.io health check and, in webhook mode, Telegram updates
+	go startHttpServer(&appConfig, b)
+	if appConfig.MetricsAddr != "" {
+		go startMetricsServer(appConfig.MetricsAddr)
+	}
 
-	// health check server for Fly.io
-	go startHealthCheckServer(&appConfig)
+	if appConfig.WebhookURL != "" {
+		if err := registerWebhook(ctx, b, &appConfig); err != nil {
+			log.Fatalf("webhook registration failed: %v", err)
+		}
+		b.StartWebhook(ctx)
+		return
+	}
 
+	if err := unregisterWebhook(ctx, b); err != nil {
+		log.Printf("warning: %v", err)
+	}
 	b.Start(ctx)
 }
 
-func startHealthCheckServer(config *Config) {
+func startHttpServer(config *Config, b *bot.Bot) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	if config.WebhookURL != "" {
+		mux.Handle(config.WebhookPath, webhookHandler(b, config.WebhookSecretToken))
+	}
 
 	serverAddr := "0.0.0.0:" + config.HttpServerPort
 	if err := http.ListenAndServe(serverAddr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Printf("health check server error: %v", err)
+		log.Printf("http server error: %v", err)
 	}
 }
 
+// startMetricsServer serves /metrics on its own address, kept off the public
+// server since the metrics list the IDs of the active chats
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", chatQueue.metricsHandler)
+	if err := http.ListenAndServe(addr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("metrics server error: %v", err)
+	}
+}
 
-func matchJsonFiles(update *models.Update) bool {
-	if update == nil || update.Message == nil {
+// matchCommand matches messages starting with /command, or /command@botUsername
+// as commands are written in groups
+func matchCommand(command, botUsername string) bot.MatchFunc {
+	return func(update *models.Update) bool {
+		if update == nil || update.Message == nil {
+			return false
+		}
+		for _, entity := range update.Message.Entities {
+			if entity.Type != models.MessageEntityTypeBotCommand || entity.Offset != 0 {
+				continue
+			}
+			if entity.Length > len(update.Message.Text) {
+				return false
+			}
+			name, target, _ := strings.Cut(update.Message.Text[1:entity.Length], "@")
+			return name == command && (target == "" || strings.EqualFold(target, botUsername))
+		}
 		return false
 	}
-	containsDocument := update.Message.Document != nil
+}
 
-	if !containsDocument {
+// matchImportFiles matches documents that may be chat exports: a result.json or
+// a ZIP of the whole export folder
+func matchImportFiles(update *models.Update) bool {
+	if update == nil || update.Message == nil || update.Message.Document == nil {
 		return false
 	}
 
-	isJSONFile := filepath.Ext(update.Message.Document.FileName) == ".json"
-
-	return isJSONFile
+	switch strings.ToLower(filepath.Ext(update.Message.Document.FileName)) {
+	case ".json", ".zip":
+		return true
+	default:
+		return false
+	}
 }
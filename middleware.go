@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"log"
-	"math/rand"
+	"slices"
 	"strings"
 
 	"github.com/go-telegram/bot"
@@ -18,15 +18,46 @@ func storeMessageMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 			chatID := update.Message.Chat.ID
 			chatStorage.StoreMessage(chatID, *update.Message)
 		}
-		
+
+		// Edits update the stored message in place and don't get a reply
+		if update.EditedMessage != nil {
+			storeEditedMessage(*update.EditedMessage)
+			return
+		}
+
 		// Continue to next middleware/handler
 		next(ctx, b, update)
 	}
 }
 
+// storeEditedMessage replaces the stored version of an edited message, storing
+// it if it predates the stored history
+func storeEditedMessage(message models.Message) {
+	chatID := message.Chat.ID
+	found, err := chatStorage.UpdateMessage(chatID, message.ID, func(stored *ChatMessage) {
+		stored.ApplyEdit(message)
+	})
+	if err != nil {
+		log.Printf("Error updating edited message %d in chat %d: %v", message.ID, chatID, err)
+		return
+	}
+	if !found {
+		if err := chatStorage.StoreMessage(chatID, message); err != nil {
+			log.Printf("Error storing edited message %d in chat %d: %v", message.ID, chatID, err)
+			return
+		}
+	}
+	invalidateEmbeddings(chatID, []int{message.ID})
+}
+
 // allowListMiddleware is a middleware that ensures only allowed chats can use the bot
 func allowListMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		// Edits from other chats are dropped silently
+		if update.EditedMessage != nil && !isChatAllowed(update.EditedMessage.Chat.ID) {
+			return
+		}
+
 		// Skip middleware checks for non-message updates
 		if update.Message == nil {
 			next(ctx, b, update)
@@ -34,21 +65,11 @@ func allowListMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 		}
 
 		chatID := update.Message.Chat.ID
-
-		// If no allow list is configured, allow all chats
-		if len(appConfig.AllowedChatIDs) == 0 {
+		if isChatAllowed(chatID) {
 			next(ctx, b, update)
 			return
 		}
 
-		// Check if the chat ID is in the allowed list
-		for _, id := range appConfig.AllowedChatIDs {
-			if id == chatID {
-				next(ctx, b, update)
-				return
-			}
-		}
-
 		// Log the rejection
 		chatName := update.Message.Chat.Title
 		if chatName == "" {
@@ -64,7 +85,16 @@ func allowListMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 	}
 }
 
-// randomReplyMiddleware decides whether to process a message in group chats based on probability
+// isChatAllowed reports whether chatID is in the allow list, if one is configured
+func isChatAllowed(chatID int64) bool {
+	// If no allow list is configured, allow all chats
+	if len(appConfig.AllowedChatIDs) == 0 {
+		return true
+	}
+	return slices.Contains(appConfig.AllowedChatIDs, chatID)
+}
+
+// randomReplyMiddleware decides whether to process a message in group chats, see shouldReplyInGroup
 // Note: Messages are already stored by storeMessageMiddleware before reaching this middleware
 func randomReplyMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
@@ -86,25 +116,31 @@ func randomReplyMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 			return
 		}
 
-		// Always process messages that explicitly mention the bot
+		// Always process messages that explicitly mention the bot or reply to it,
+		// including photos and stickers without caption
+		text := update.Message.Text
+		if text == "" {
+			text = update.Message.Caption
+		}
 		me, err := b.GetMe(ctx)
-		if err == nil && update.Message.Text != "" {
-			botName := "@" + me.Username
-			if strings.Contains(update.Message.Text, botName) || 
-			   (update.Message.ReplyToMessage != nil && update.Message.ReplyToMessage.From.ID == me.ID) {
+		if err == nil {
+			mentioned := text != "" && strings.Contains(text, "@"+me.Username)
+			replied := update.Message.ReplyToMessage != nil && update.Message.ReplyToMessage.From != nil &&
+				update.Message.ReplyToMessage.From.ID == me.ID
+			if mentioned || replied {
 				next(ctx, b, update)
 				return
 			}
 		}
 
-		// Use probability for other messages in group chats
-		if rand.Float64() <= appConfig.GroupReplyProbability {
+		// Decide whether other messages in group chats are worth an answer
+		if shouldReplyInGroup(ctx, b, update.Message) {
 			next(ctx, b, update)
 			return
 		}
 
 		// If we decide not to reply, just log it and return
 		// The message has already been stored by storeMessageMiddleware
-		log.Printf("Randomly skipping reply to message in group chat %d", update.Message.Chat.ID)
+		log.Printf("Skipping reply to message in group chat %d", update.Message.Chat.ID)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/shared"
+)
+
+// Group reply modes selectable through GROUP_REPLY_MODE
+const (
+	GroupReplyModeProbability = "probability" // Coin flip with GROUP_REPLY_PROBABILITY
+	GroupReplyModeHeuristic   = "heuristic"   // Conversation heuristics only
+	GroupReplyModeModel       = "model"       // Heuristics, asking a cheap model when they are not conclusive
+	GroupReplyModeReply       = "reply"       // Always run the reply model, which may answer with skip
+)
+
+// Heuristic scores outside the skip and answer bounds are conclusive and skip
+// the model call, the threshold is used when the heuristics decide alone
+const (
+	replyScoreSkip      = 0.2
+	replyScoreThreshold = 0.5
+	replyScoreAnswer    = 0.8
+)
+
+// decisionHistory is how many recent messages the decision looks at
+const decisionHistory = 20
+
+// ShouldReplyResponse represents the JSON structure returned by the decision model
+type ShouldReplyResponse struct {
+	Reason  string `json:"reason"`
+	Respond bool   `json:"respond"`
+}
+
+// replySignals are the heuristics computed on the latest group message
+type replySignals struct {
+	IsQuestion        bool
+	PersonaMatches    []string
+	SinceBotLastSpoke time.Duration // Zero if the bot never spoke
+}
+
+// Score combines the signals in a 0-1 likelihood that answering makes sense
+func (s replySignals) Score() float64 {
+	score := 0.3
+	if s.IsQuestion {
+		score += 0.3
+	}
+	score += 0.15 * float64(min(len(s.PersonaMatches), 2))
+
+	switch {
+	case s.SinceBotLastSpoke == 0 || s.SinceBotLastSpoke > 30*time.Minute:
+		score += 0.1
+	case s.SinceBotLastSpoke < 2*time.Minute:
+		score -= 0.3
+	}
+
+	return max(0, min(score, 1))
+}
+
+// String describes the signals for the decision prompt
+func (s replySignals) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "- The latest message is a question: %t\n", s.IsQuestion)
+	if len(s.PersonaMatches) > 0 {
+		fmt.Fprintf(&sb, "- Words related to the persona: %s\n", strings.Join(s.PersonaMatches, ", "))
+	} else {
+		sb.WriteString("- No words related to the persona\n")
+	}
+	if s.SinceBotLastSpoke == 0 {
+		sb.WriteString("- The character hasn't spoken recently\n")
+	} else {
+		fmt.Fprintf(&sb, "- The character last spoke %s ago\n", s.SinceBotLastSpoke.Round(time.Second))
+	}
+	return sb.String()
+}
+
+// words splits text in lowercase words
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// personaMatches returns the words of text that also appear in the persona.
+// Short words are ignored, they are mostly articles and pronouns.
+func personaMatches(text, persona string) []string {
+	const minWordLength = 5
+
+	personaWords := make(map[string]bool)
+	for _, word := range words(persona) {
+		if len([]rune(word)) >= minWordLength {
+			personaWords[word] = true
+		}
+	}
+
+	var matches []string
+	for _, word := range words(text) {
+		if personaWords[word] {
+			matches = append(matches, word)
+			delete(personaWords, word)
+		}
+	}
+	return matches
+}
+
+// computeReplySignals computes the heuristics for message given the recent history
+func computeReplySignals(message *models.Message, state ChatState) replySignals {
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+
+	signals := replySignals{
+		IsQuestion:     strings.Contains(text, "?"),
+		PersonaMatches: personaMatches(text, state.Prompt),
+	}
+
+	for i := len(state.Messages) - 1; i >= 0; i-- {
+		if state.Messages[i].IsFromBot && !state.Messages[i].Deleted {
+			signals.SinceBotLastSpoke = max(time.Duration(int64(message.Date)-state.Messages[i].Date)*time.Second, time.Second)
+			break
+		}
+	}
+
+	return signals
+}
+
+// askShouldReply asks the decision model whether to answer
+func askShouldReply(ctx context.Context, b *bot.Bot, state ChatState, signals replySignals) (ShouldReplyResponse, error) {
+	var result ShouldReplyResponse
+
+	botName := "@Bot"
+	if me, err := b.GetMe(ctx); err == nil {
+		botName = "@" + me.Username
+	}
+
+	lastMessages, err := json.Marshal(fitMessages(state.Messages, llmRegistry.ContextTokens(LLMTaskShouldReply)))
+	if err != nil {
+		return result, fmt.Errorf("failed to marshal messages: %w", err)
+	}
+
+	prompt := promptShouldReply
+	prompt = strings.Replace(prompt, "{{PROMPT}}", state.Prompt, 1)
+	prompt = strings.Replace(prompt, "{{LAST_MESSAGES}}", string(lastMessages), 1)
+	prompt = strings.Replace(prompt, "{{SIGNALS}}", signals.String(), 1)
+	prompt = strings.ReplaceAll(prompt, "{{BOT_NAME}}", botName)
+
+	resp, err := llmRegistry.Complete(ctx, LLMTaskShouldReply, openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.UserMessage(prompt),
+		},
+		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
+			OfJSONObject: &shared.ResponseFormatJSONObjectParam{},
+		},
+	})
+	if err != nil {
+		return result, err
+	}
+	if len(resp.Choices) == 0 {
+		return result, fmt.Errorf("empty response")
+	}
+
+	if err := json.Unmarshal([]byte(resp.Choices[0].Message.Content), &result); err != nil {
+		return result, fmt.Errorf("failed to parse decision: %w", err)
+	}
+	return result, nil
+}
+
+// shouldReplyInGroup decides whether to answer a group message that doesn't address the bot
+func shouldReplyInGroup(ctx context.Context, b *bot.Bot, message *models.Message) bool {
+	chatID := message.Chat.ID
+
+	settings := loadChatSettings(chatID)
+	if settings.IsSilent(time.Now()) {
+		return false
+	}
+	if settings.ReplyProbability != nil {
+		return rand.Float64() <= *settings.ReplyProbability
+	}
+
+	switch appConfig.GroupReplyMode {
+	case GroupReplyModeReply:
+		return true
+	case GroupReplyModeProbability:
+		return rand.Float64() <= appConfig.GroupReplyProbability
+	}
+
+	state, _ := chatStorage.GetChatState(chatID, decisionHistory)
+	signals := computeReplySignals(message, state)
+	score := signals.Score()
+
+	if appConfig.GroupReplyMode == GroupReplyModeHeuristic {
+		log.Printf("Reply score %.2f for message %d in chat %d", score, message.ID, chatID)
+		return score >= replyScoreThreshold
+	}
+
+	switch {
+	case score < replyScoreSkip:
+		log.Printf("Reply score %.2f for message %d in chat %d, skipping", score, message.ID, chatID)
+		return false
+	case score >= replyScoreAnswer:
+		log.Printf("Reply score %.2f for message %d in chat %d, answering", score, message.ID, chatID)
+		return true
+	}
+
+	decision, err := askShouldReply(ctx, b, state, signals)
+	if err != nil {
+		// Fall back to the heuristics rather than muting the character
+		log.Printf("Error deciding whether to reply in chat %d: %v", chatID, err)
+		return score >= replyScoreThreshold
+	}
+
+	log.Printf("Reply decision for message %d in chat %d: %t (%s)", message.ID, chatID, decision.Respond, decision.Reason)
+	return decision.Respond
+}
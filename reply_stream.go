@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+)
+
+// Patterns locating the first reply in a partial JSON response
+var (
+	partialMessagesStart        = regexp.MustCompile(`"messages"\s*:\s*\[\s*\{`)
+	partialTextStart            = regexp.MustCompile(`"text"\s*:\s*"`)
+	partialReplyToID            = regexp.MustCompile(`"reply_to_id"\s*:\s*(\d+)`)
+	partialResponseMessageStart = regexp.MustCompile(`"response_message"\s*:\s*"`)
+	partialSkip                 = regexp.MustCompile(`"skip"\s*:\s*true`)
+)
+
+// partialFirstReply extracts the first reply from a possibly incomplete JSON
+// response, returning the text generated so far. Nothing is returned once the
+// model chose to stay silent.
+func partialFirstReply(raw string) ReplyMessage {
+	if partialSkip.MatchString(raw) {
+		return ReplyMessage{}
+	}
+	if loc := partialMessagesStart.FindStringIndex(raw); loc != nil {
+		object := raw[loc[1]:]
+		textLoc := partialTextStart.FindStringIndex(object)
+		if textLoc == nil {
+			return ReplyMessage{}
+		}
+
+		reply := ReplyMessage{Text: partialJSONString(object[textLoc[1]:])}
+		if match := partialReplyToID.FindStringSubmatch(object[:textLoc[0]]); match != nil {
+			reply.ReplyToID, _ = strconv.Atoi(match[1])
+		}
+		return reply
+	}
+
+	if loc := partialResponseMessageStart.FindStringIndex(raw); loc != nil {
+		return ReplyMessage{Text: partialJSONString(raw[loc[1]:])}
+	}
+	return ReplyMessage{}
+}
+
+// partialJSONString decodes the JSON string starting at rest, right after its
+// opening quote, up to its closing quote or the last complete character
+func partialJSONString(rest string) string {
+	// Find where the string ends, or the last complete character if it doesn't yet
+	end := 0
+	for end < len(rest) {
+		c := rest[end]
+		if c == '"' {
+			break
+		}
+		if c != '\\' {
+			end++
+			continue
+		}
+		if end+1 >= len(rest) {
+			break
+		}
+		if rest[end+1] != 'u' {
+			end += 2
+			continue
+		}
+		if end+6 > len(rest) {
+			break
+		}
+		// Keep a high surrogate until its pair arrives
+		if hex := strings.ToLower(rest[end+2 : end+4]); hex >= "d8" && hex <= "db" && end+12 > len(rest) {
+			break
+		}
+		end += 6
+	}
+
+	var message string
+	if err := json.Unmarshal([]byte(`"`+rest[:end]+`"`), &message); err != nil {
+		return ""
+	}
+	return message
+}
+
+// streamChatReply streams the reply for req, sending the first message as soon as it
+// starts and editing it as tokens arrive. The other messages are sent once the
+// response is complete. The final texts are stored in the chat history like
+// sendChatMessage does.
+func streamChatReply(ctx context.Context, b *bot.Bot, chatID int64, req openai.ChatCompletionNewParams) {
+	var (
+		sent     *models.Message
+		sentText string
+		lastEdit time.Time
+	)
+
+	update := func(reply ReplyMessage) {
+		text := strings.TrimSpace(reply.Text)
+		if text == "" || text == sentText {
+			return
+		}
+
+		if sent == nil {
+			msg, err := b.SendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          chatID,
+				Text:            text,
+				ReplyParameters: replyParameters(reply.ReplyToID),
+			})
+			if err != nil {
+				log.Printf("Error sending message: %v", err)
+				return
+			}
+			sent, sentText, lastEdit = msg, text, time.Now()
+			return
+		}
+
+		msg, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    chatID,
+			MessageID: sent.ID,
+			Text:      text,
+		})
+		if err != nil {
+			log.Printf("Error editing message: %v", err)
+			return
+		}
+		sent, sentText, lastEdit = msg, text, time.Now()
+	}
+
+	raw, err := llmRegistry.Stream(ctx, LLMTaskReply, req, func(content string) {
+		// Stay within Telegram's edit rate limits, the final text is always sent below
+		if sent != nil && time.Since(lastEdit) < appConfig.StreamEditInterval {
+			return
+		}
+		update(partialFirstReply(content))
+	})
+	if err != nil {
+		log.Printf("Error calling llm model: %v", err)
+	}
+
+	// unsend deletes the message streamed so far, it won't be stored
+	unsend := func() {
+		if sent == nil {
+			return
+		}
+		if _, err := b.DeleteMessage(ctx, &bot.DeleteMessageParams{ChatID: chatID, MessageID: sent.ID}); err != nil {
+			log.Printf("Error deleting streamed message %d in chat %d: %v", sent.ID, chatID, err)
+		}
+		sent = nil
+	}
+
+	var rest []ReplyMessage
+	if err == nil {
+		result, parseErr := parseReply(raw)
+		replies := result.Replies()
+		switch {
+		case parseErr != nil && sent == nil:
+			sendChatMessage(ctx, b, chatID, replyFormatFallback(raw), 0)
+			return
+		case parseErr != nil:
+			log.Printf("Error parsing streamed response: %v", parseErr)
+		case result.Skip:
+			log.Printf("Model chose to skip replying in chat %d", chatID)
+			// Take back what was streamed before the model said so
+			unsend()
+		case len(replies) == 0:
+		case replies[0].Voice && loadChatSettings(chatID).CanSpeak():
+			// Voice notes can't be streamed, the voice note replaces the streamed text
+			unsend()
+			rest = replies
+		default:
+			update(replies[0])
+			rest = replies[1:]
+		}
+		if parseErr == nil && result.Reaction != nil && !result.Skip {
+			setChatReaction(ctx, b, chatID, *result.Reaction)
+		}
+	}
+
+	if sent != nil {
+		if err := chatStorage.StoreMessage(chatID, *sent); err != nil {
+			log.Printf("Error storing message: %v", err)
+		}
+	}
+	// Streamed replies are sent as soon as they are generated, without typing delay
+	sendReplies(ctx, b, chatID, rest, 0, false)
+}
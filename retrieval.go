@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+const (
+	// embeddingBatchSize is how many messages are embedded per request
+	embeddingBatchSize = 100
+	// embeddingMaxChars truncates long messages, their start is enough to find them
+	embeddingMaxChars = 2000
+	// embeddingIndexInterval is the minimum time between two indexings of a chat
+	embeddingIndexInterval = 10 * time.Minute
+	// embeddingIndexIdle is how long the index of a chat stays in memory unsearched
+	embeddingIndexIdle = time.Hour
+	// embeddingIndexTimeout bounds an indexing, which runs in the background
+	embeddingIndexTimeout = 30 * time.Minute
+	// retrievalQueryMessages is how many recent messages make up the search query
+	retrievalQueryMessages = 5
+	// retrievalTimeout bounds the search made before each reply
+	retrievalTimeout = 10 * time.Second
+)
+
+// Embedder turns texts into normalized vectors with an OpenAI-compatible /embeddings endpoint
+type Embedder struct {
+	client     openai.Client
+	model      string
+	dimensions int64
+}
+
+// NewEmbedder creates the embedder of the chat archive search, nil when disabled
+func NewEmbedder(config Config) *Embedder {
+	if config.Retrieval.Provider == "" {
+		return nil
+	}
+	provider := config.LLMProviders[config.Retrieval.Provider]
+	return &Embedder{
+		client: openai.NewClient(
+			option.WithBaseURL(provider.BaseURL),
+			option.WithAPIKey(provider.APIKey),
+		),
+		model:      config.Retrieval.Model,
+		dimensions: config.Retrieval.Dimensions,
+	}
+}
+
+// Embed returns the vectors of texts, in order, scaled to unit length so that
+// their dot product is the cosine similarity
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	params := openai.EmbeddingNewParams{
+		Input: openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: texts},
+		Model: openai.EmbeddingModel(e.model),
+	}
+	if e.dimensions > 0 {
+		params.Dimensions = openai.Int(e.dimensions)
+	}
+
+	resp, err := e.client.Embeddings.New(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d texts", len(resp.Data), len(texts))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, data := range resp.Data {
+		if data.Index < 0 || int(data.Index) >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+		}
+		vectors[data.Index] = normalizeEmbedding(data.Embedding)
+	}
+	return vectors, nil
+}
+
+// normalizeEmbedding converts an embedding to float32 with unit length
+func normalizeEmbedding(embedding []float64) []float32 {
+	var norm float64
+	for _, v := range embedding {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		norm = 1
+	}
+
+	vector := make([]float32, len(embedding))
+	for i, v := range embedding {
+		vector[i] = float32(v / norm)
+	}
+	return vector
+}
+
+// encodeEmbedding serializes a vector as little-endian float32 values for storage
+func encodeEmbedding(vector []float32) []byte {
+	data := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return data
+}
+
+// decodeEmbedding reverses encodeEmbedding
+func decodeEmbedding(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector
+}
+
+// embeddingText is the text of message that gets embedded, empty when there is
+// nothing to search for
+func embeddingText(message ChatMessage) string {
+	content := message.Text
+	if content == "" {
+		content = message.Caption
+	}
+	if message.Description != "" {
+		content = strings.TrimSpace(content + "\n" + message.Description)
+	}
+	if message.Deleted || content == "" || strings.HasPrefix(content, "/") {
+		return ""
+	}
+
+	if runes := []rune(content); len(runes) > embeddingMaxChars {
+		content = string(runes[:embeddingMaxChars])
+	}
+	if message.FromUser != "" {
+		content = message.FromUser + ": " + content
+	}
+	return content
+}
+
+// chatIndex holds the embeddings of the messages of a chat, loaded from storage
+// on first use and kept up to date by background indexings
+type chatIndex struct {
+	mu       sync.Mutex
+	vectors  map[int][]float32
+	loaded   bool
+	cursor   int          // Newest message ID already indexed
+	stale    map[int]bool // Older messages to embed again, edited or imported
+	indexing bool
+	lastRun  time.Time
+	lastUsed time.Time // Guarded by messageIndex
+	dropped  bool      // Replaced by a new index, a running indexing must not store anything
+}
+
+// messageIndex keeps the indexes of the chats searched recently in memory,
+// the others are evicted after embeddingIndexIdle
+var messageIndex = struct {
+	sync.Mutex
+	chats     map[int64]*chatIndex
+	lastSweep time.Time
+}{chats: make(map[int64]*chatIndex)}
+
+// getChatIndex returns the index of chatID, creating it if needed
+func getChatIndex(chatID int64) *chatIndex {
+	messageIndex.Lock()
+	defer messageIndex.Unlock()
+
+	now := time.Now()
+	if now.Sub(messageIndex.lastSweep) >= embeddingIndexInterval {
+		messageIndex.lastSweep = now
+		for id, index := range messageIndex.chats {
+			// A locked index is in use, so not idle
+			if now.Sub(index.lastUsed) < embeddingIndexIdle || !index.mu.TryLock() {
+				continue
+			}
+			if !index.indexing && len(index.stale) == 0 {
+				delete(messageIndex.chats, id)
+			}
+			index.mu.Unlock()
+		}
+	}
+
+	index, ok := messageIndex.chats[chatID]
+	if !ok {
+		index = &chatIndex{}
+		messageIndex.chats[chatID] = index
+	}
+	index.lastUsed = now
+	return index
+}
+
+// dropChatIndex forgets the in-memory index of chatID, after its history was
+// replaced, and stops the indexing of the old history if it is running
+func dropChatIndex(chatID int64) {
+	messageIndex.Lock()
+	index, ok := messageIndex.chats[chatID]
+	delete(messageIndex.chats, chatID)
+	messageIndex.Unlock()
+
+	if ok {
+		index.mu.Lock()
+		index.dropped = true
+		index.mu.Unlock()
+	}
+}
+
+// invalidateEmbeddings deletes the embeddings of the messages of chatID with
+// the given IDs, whose content changed, and queues them for the next indexing
+func invalidateEmbeddings(chatID int64, ids []int) {
+	if embedder == nil || len(ids) == 0 {
+		return
+	}
+	idx := getChatIndex(chatID)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := chatStorage.DeleteEmbeddings(chatID, ids); err != nil {
+		log.Printf("Error deleting embeddings of chat %d: %v", chatID, err)
+	}
+	if idx.stale == nil {
+		idx.stale = make(map[int]bool)
+	}
+	for _, id := range ids {
+		delete(idx.vectors, id)
+		idx.stale[id] = true
+	}
+}
+
+// load reads the stored embeddings of chatID once. Callers must hold the lock.
+func (idx *chatIndex) load(chatID int64) error {
+	if idx.loaded {
+		return nil
+	}
+	vectors, err := chatStorage.GetEmbeddings(chatID)
+	if err != nil {
+		return err
+	}
+	idx.vectors, idx.loaded = vectors, true
+	for id := range vectors {
+		idx.cursor = max(idx.cursor, id)
+	}
+	return nil
+}
+
+// scheduleIndexing starts indexing the new messages of chatID in the background,
+// unless it is already running or ran recently
+func scheduleIndexing(chatID int64) {
+	idx := getChatIndex(chatID)
+
+	idx.mu.Lock()
+	due := !idx.indexing && time.Since(idx.lastRun) >= embeddingIndexInterval
+	if due {
+		idx.indexing = true
+		idx.lastRun = time.Now()
+	}
+	idx.mu.Unlock()
+
+	if due {
+		go func() {
+			defer func() {
+				idx.mu.Lock()
+				idx.indexing = false
+				idx.mu.Unlock()
+			}()
+			indexChat(chatID, idx)
+		}()
+	}
+}
+
+// indexChat embeds and stores the stale messages of chatID, then the ones
+// received since the last indexing, the whole archive the first time
+func indexChat(chatID int64, idx *chatIndex) {
+	ctx, cancel := context.WithTimeout(context.Background(), embeddingIndexTimeout)
+	defer cancel()
+
+	idx.mu.Lock()
+	err := idx.load(chatID)
+	var stale []int
+	if err == nil {
+		for id := range idx.stale {
+			stale = append(stale, id)
+		}
+		clear(idx.stale)
+	}
+	cursor := idx.cursor
+	idx.mu.Unlock()
+	if err != nil {
+		log.Printf("Error loading embeddings of chat %d: %v", chatID, err)
+		return
+	}
+
+	indexed := 0
+	if len(stale) > 0 {
+		messages, err := chatStorage.GetMessagesByID(chatID, stale)
+		if err != nil {
+			log.Printf("Error getting edited messages of chat %d: %v", chatID, err)
+			return
+		}
+		for batch := range slices.Chunk(messages, embeddingBatchSize) {
+			n, ok := idx.embed(ctx, chatID, batch)
+			indexed += n
+			if !ok {
+				return
+			}
+		}
+	}
+
+	for {
+		messages, err := chatStorage.GetMessagesAfter(chatID, cursor, embeddingBatchSize)
+		if err != nil {
+			log.Printf("Error getting messages of chat %d: %v", chatID, err)
+			break
+		}
+		if len(messages) == 0 {
+			break
+		}
+		n, ok := idx.embed(ctx, chatID, messages)
+		indexed += n
+		if !ok {
+			break
+		}
+
+		cursor = messages[len(messages)-1].ID
+		idx.mu.Lock()
+		idx.cursor = max(idx.cursor, cursor)
+		idx.mu.Unlock()
+		if len(messages) < embeddingBatchSize {
+			break
+		}
+	}
+	if indexed > 0 {
+		log.Printf("Indexed %d messages of chat %d", indexed, chatID)
+	}
+}
+
+// embed embeds and stores the searchable messages among messages, at most
+// embeddingBatchSize of them. It returns how many were stored, and false when
+// the indexing must stop.
+func (idx *chatIndex) embed(ctx context.Context, chatID int64, messages []ChatMessage) (int, bool) {
+	var ids []int
+	var texts []string
+	for _, message := range messages {
+		if text := embeddingText(message); text != "" {
+			ids = append(ids, message.ID)
+			texts = append(texts, text)
+		}
+	}
+	if len(texts) == 0 {
+		return 0, true
+	}
+
+	vectors, err := embedder.Embed(ctx, texts)
+	if err != nil {
+		log.Printf("Error embedding messages of chat %d: %v", chatID, err)
+		return 0, false
+	}
+
+	// Stored under the lock, so that nothing is stored once the index is dropped
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.dropped {
+		log.Printf("Stopped indexing chat %d, its history was replaced", chatID)
+		return 0, false
+	}
+	embeddings := make(map[int][]float32, len(ids))
+	for i, id := range ids {
+		// Edited since it was read, embedded again by the next indexing
+		if !idx.stale[id] {
+			embeddings[id] = vectors[i]
+		}
+	}
+	if len(embeddings) == 0 {
+		return 0, true
+	}
+	if err := chatStorage.StoreEmbeddings(chatID, embeddings); err != nil {
+		log.Printf("Error storing embeddings of chat %d: %v", chatID, err)
+		return 0, false
+	}
+	maps.Copy(idx.vectors, embeddings)
+	return len(embeddings), true
+}
+
+// retrieveMessages searches the archive of chatID for the messages most related
+// to the recent ones, among those older than the before message ID that are
+// already in the prompt. It also starts indexing the messages received since
+// the last search.
+func retrieveMessages(ctx context.Context, chatID int64, recent []ChatMessage, before int) []ChatMessage {
+	if embedder == nil || len(recent) == 0 {
+		return nil
+	}
+	scheduleIndexing(chatID)
+
+	var query []string
+	for _, message := range recent[max(len(recent)-retrievalQueryMessages, 0):] {
+		if text := embeddingText(message); text != "" {
+			query = append(query, text)
+		}
+	}
+	if len(query) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, retrievalTimeout)
+	defer cancel()
+	vectors, err := embedder.Embed(ctx, []string{strings.Join(query, "\n")})
+	if err != nil {
+		log.Printf("Error embedding the search of chat %d: %v", chatID, err)
+		return nil
+	}
+	queryVector := vectors[0]
+
+	type match struct {
+		id    int
+		score float32
+	}
+	var matches []match
+
+	idx := getChatIndex(chatID)
+	idx.mu.Lock()
+	if err := idx.load(chatID); err != nil {
+		log.Printf("Error loading embeddings of chat %d: %v", chatID, err)
+	}
+	for id, vector := range idx.vectors {
+		if id >= before || len(vector) != len(queryVector) {
+			continue
+		}
+		var score float32
+		for i, v := range vector {
+			score += v * queryVector[i]
+		}
+		matches = append(matches, match{id, score})
+	}
+	idx.mu.Unlock()
+
+	slices.SortFunc(matches, func(a, b match) int {
+		if a.score != b.score {
+			if a.score > b.score {
+				return -1
+			}
+			return 1
+		}
+		return b.id - a.id
+	})
+	ids := make([]int, 0, appConfig.Retrieval.TopK)
+	for _, m := range matches[:min(len(matches), appConfig.Retrieval.TopK)] {
+		ids = append(ids, m.id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	messages, err := chatStorage.GetMessagesByID(chatID, ids)
+	if err != nil {
+		log.Printf("Error getting retrieved messages of chat %d: %v", chatID, err)
+		return nil
+	}
+	return slices.DeleteFunc(messages, func(m ChatMessage) bool { return m.Deleted })
+}
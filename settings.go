@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// ChatSettings are the per-chat overrides of the process-wide configuration,
+// changed with /settings. Unset fields fall back to Config.
+type ChatSettings struct {
+	ReplyProbability  *float64       `json:"reply_probability,omitempty"`    // Coin flip for group messages, replaces GROUP_REPLY_MODE
+	ReplyDelayPerChar *time.Duration `json:"reply_delay_per_char,omitempty"` // Simulated typing time per character
+	Model             string         `json:"model,omitempty"`                // "provider:model" route of the replies
+	HistoryMessages   int            `json:"history_messages,omitempty"`     // Maximum messages in the reply prompt, zero for the token budget only
+	Language          string         `json:"language,omitempty"`             // Language of the replies, empty to follow the chat
+	SilenceHours      *SilenceHours  `json:"silence_hours,omitempty"`        // Hours of the day without replies
+	VoiceReplies      *bool          `json:"voice_replies,omitempty"`        // Let the character send voice notes
+}
+
+// SilenceHours is a daily window without replies, from Start up to End
+// (exclusive) in the server time zone. The window may wrap around midnight.
+type SilenceHours struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Contains reports whether t falls in the window
+func (h SilenceHours) Contains(t time.Time) bool {
+	hour := t.Hour()
+	if h.Start <= h.End {
+		return hour >= h.Start && hour < h.End
+	}
+	return hour >= h.Start || hour < h.End
+}
+
+func (h SilenceHours) String() string {
+	return fmt.Sprintf("%02d:00-%02d:00", h.Start, h.End)
+}
+
+// loadChatSettings returns the settings of chatID, or the defaults if they can't be read
+func loadChatSettings(chatID int64) ChatSettings {
+	settings, err := chatStorage.GetSettings(chatID)
+	if err != nil {
+		log.Printf("Error getting settings of chat %d: %v", chatID, err)
+		return ChatSettings{}
+	}
+	return settings
+}
+
+// IsSilent reports whether the chat must not be answered at t
+func (s ChatSettings) IsSilent(t time.Time) bool {
+	return s.SilenceHours != nil && s.SilenceHours.Contains(t)
+}
+
+// ReplyDelay returns the simulated typing time per character in chatID
+func (s ChatSettings) ReplyDelay(chatID int64) time.Duration {
+	if s.ReplyDelayPerChar != nil {
+		return *s.ReplyDelayPerChar
+	}
+	if override, ok := appConfig.ReplyDelayChatOverrides[chatID]; ok {
+		return override
+	}
+	return appConfig.ReplyDelayPerChar
+}
+
+// HistoryLimit caps limit, the number of messages read for the reply prompt, by the history window
+func (s ChatSettings) HistoryLimit(limit int) int {
+	if s.HistoryMessages > 0 {
+		return min(limit, s.HistoryMessages)
+	}
+	return limit
+}
+
+// LanguageInstruction describes the language replies must be written in
+func (s ChatSettings) LanguageInstruction() string {
+	if s.Language == "" {
+		return "the language the chat is using"
+	}
+	return s.Language
+}
+
+// CanSpeak reports whether the character may answer with voice notes: a
+// text-to-speech backend is configured and the chat didn't turn them off
+func (s ChatSettings) CanSpeak() bool {
+	return speaker != nil && (s.VoiceReplies == nil || *s.VoiceReplies)
+}
+
+// VoiceInstruction tells the character it can send voice notes, empty when it can't
+func (s ChatSettings) VoiceInstruction() string {
+	if !s.CanSpeak() {
+		return ""
+	}
+	return "\n- You can speak instead of typing: set \"voice\" to true on a message to send it as a voice note. Do it when your persona would, not for every message, and write spoken words only, without emoji, links or formatting."
+}
+
+// ReplyRoute returns the reply route chosen for the chat among LLM_REPLY_MODELS
+func (s ChatSettings) ReplyRoute() (LLMTaskConfig, bool) {
+	if s.Model == "" {
+		return LLMTaskConfig{}, false
+	}
+	for _, route := range appConfig.LLMReplyModels {
+		if route.Route() == s.Model {
+			return route, true
+		}
+	}
+	// The model was removed from the configuration since it was chosen
+	log.Printf("Ignoring unavailable reply model %s", s.Model)
+	return LLMTaskConfig{}, false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// Text-to-speech backends selectable through TTS_BACKEND
+const (
+	SpeechBackendNone    = "none"
+	SpeechBackendAPI     = "api"     // OpenAI-compatible /audio/speech endpoint
+	SpeechBackendCommand = "command" // Local text-to-speech binary
+)
+
+// maxSpeechSize bounds the audio of a voice reply, well above a few minutes of Opus
+const maxSpeechSize = 20 << 20
+
+// Speaker turns text into a voice note, OGG/Opus audio Telegram plays inline
+type Speaker interface {
+	Speak(ctx context.Context, text string) ([]byte, error)
+}
+
+// NewSpeaker creates the configured text-to-speech backend, nil when disabled
+func NewSpeaker(config Config) Speaker {
+	switch config.Speech.Backend {
+	case SpeechBackendAPI:
+		provider := config.LLMProviders[config.Speech.Provider]
+		return &APISpeaker{
+			client: openai.NewClient(
+				option.WithBaseURL(provider.BaseURL),
+				option.WithAPIKey(provider.APIKey),
+			),
+			model: config.Speech.Model,
+			voice: config.Speech.Voice,
+		}
+	case SpeechBackendCommand:
+		return &CommandSpeaker{args: config.Speech.Command}
+	default:
+		return nil
+	}
+}
+
+// APISpeaker speaks with an OpenAI-compatible /audio/speech endpoint
+type APISpeaker struct {
+	client openai.Client
+	model  string
+	voice  string
+}
+
+func (s *APISpeaker) Speak(ctx context.Context, text string) ([]byte, error) {
+	resp, err := s.client.Audio.Speech.New(ctx, openai.AudioSpeechNewParams{
+		Input:          text,
+		Model:          openai.SpeechModel(s.model),
+		Voice:          openai.AudioSpeechNewParamsVoice(s.voice),
+		ResponseFormat: openai.AudioSpeechNewParamsResponseFormatOpus,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return readSpeech(resp.Body)
+}
+
+// CommandSpeaker runs a local command that reads the text from its standard
+// input and writes the audio to its standard output, or to the "{file}" argument
+// which is replaced by a temporary path.
+type CommandSpeaker struct {
+	args []string
+}
+
+func (s *CommandSpeaker) Speak(ctx context.Context, text string) ([]byte, error) {
+	var outPath string
+	args := make([]string, 0, len(s.args))
+	for _, arg := range s.args {
+		if strings.Contains(arg, "{file}") {
+			if outPath == "" {
+				tmpFile, err := os.CreateTemp("", "speech-*.ogg")
+				if err != nil {
+					return nil, fmt.Errorf("failed to create temp file: %w", err)
+				}
+				tmpFile.Close()
+				outPath = tmpFile.Name()
+				defer os.Remove(outPath)
+			}
+			arg = strings.ReplaceAll(arg, "{file}", outPath)
+		}
+		args = append(args, arg)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("speech command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if outPath == "" {
+		return readSpeech(&stdout)
+	}
+	file, err := os.Open(outPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open speech output: %w", err)
+	}
+	defer file.Close()
+	return readSpeech(file)
+}
+
+// readSpeech reads generated audio, failing if it is empty or exceeds maxSpeechSize
+func readSpeech(r io.Reader) ([]byte, error) {
+	audio, err := io.ReadAll(io.LimitReader(r, maxSpeechSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read speech: %w", err)
+	}
+	if len(audio) == 0 {
+		return nil, fmt.Errorf("empty speech")
+	}
+	if len(audio) > maxSpeechSize {
+		return nil, fmt.Errorf("speech too large: more than %d bytes", maxSpeechSize)
+	}
+	return audio, nil
+}
+
+// sendChatVoice speaks text and sends it as a voice note, as a reply to replyToID
+// when not zero. The text is stored in chat history like sendChatMessage does,
+// and sent as a text message instead if it can't be spoken.
+func sendChatVoice(ctx context.Context, b *bot.Bot, chatID int64, text string, replyToID int) {
+	stopRecording := startChatAction(ctx, b, chatID, models.ChatActionRecordVoice)
+	audio, err := speaker.Speak(ctx, text)
+	stopRecording()
+	if err != nil {
+		log.Printf("Error speaking reply in chat %d, sending it as text: %v", chatID, err)
+		sendChatMessage(ctx, b, chatID, text, replyToID)
+		return
+	}
+
+	msg, err := b.SendVoice(ctx, &bot.SendVoiceParams{
+		ChatID:          chatID,
+		Voice:           &models.InputFileUpload{Filename: "voice.ogg", Data: bytes.NewReader(audio)},
+		ReplyParameters: replyParameters(replyToID),
+	})
+	if err != nil {
+		log.Printf("Error sending voice message in chat %d, sending it as text: %v", chatID, err)
+		sendChatMessage(ctx, b, chatID, text, replyToID)
+		return
+	}
+
+	// The spoken text is the content of the voice note, as transcripts are
+	msg.Text = text
+	chatStorage.StoreMessage(chatID, *msg)
+}
@@ -5,13 +5,125 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"sort"
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-telegram/bot/models"
 	"github.com/redis/go-redis/v9"
 )
 
+// ChatStore is the persistence layer used by the handlers. Implementations
+// must be safe for concurrent use.
+type ChatStore interface {
+	StoreMessage(chatID int64, message models.Message) error
+	UpdateMessage(chatID int64, messageID int, update func(*ChatMessage)) (bool, error)
+	ImportChat(chatID int64, messages []ChatMessage, opts ImportOptions) (ImportResult, error)
+	GetChatState(chatID int64, limit int) (ChatState, bool)
+	SetPrompt(chatID int64, prompt string) error
+	SetSummary(chatID int64, summary string) error
+	GetSettings(chatID int64) (ChatSettings, error)
+	SetSettings(chatID int64, settings ChatSettings) error
+	GetMemories(chatID int64) (ChatMemories, error)
+	SetMemories(chatID int64, memories ChatMemories) error
+	GetMessagesByID(chatID int64, ids []int) ([]ChatMessage, error)
+	GetMessagesAfter(chatID int64, afterID, limit int) ([]ChatMessage, error)
+	GetEmbeddings(chatID int64) (map[int][]float32, error)
+	StoreEmbeddings(chatID int64, embeddings map[int][]float32) error
+	DeleteEmbeddings(chatID int64, ids []int) error
+	SetPendingImport(token string, pending PendingImport, ttl time.Duration) error
+	GetPendingImport(token string) (PendingImport, bool, error)
+	DeletePendingImport(token string) (bool, error)
+	Ping() error
+	Close() error
+}
+
+// ImportOptions controls how an import is combined with the stored chat
+type ImportOptions struct {
+	Replace      bool // Drop the stored history instead of merging into it
+	ResetPrompt  bool
+	ResetSummary bool
+}
+
+// ImportResult reports what an import did to the stored history
+type ImportResult struct {
+	Added   int
+	Updated int
+	Skipped int
+	Changed []int // IDs of the added and updated messages
+}
+
+// merge decides whether incoming must be written over existing (nil when the
+// message isn't stored yet) and counts the outcome. Duplicates are skipped and
+// the copy with the newer edit wins.
+func (r *ImportResult) merge(existing *ChatMessage, incoming ChatMessage) bool {
+	switch {
+	case existing == nil:
+		r.Added++
+		r.Changed = append(r.Changed, incoming.ID)
+		return true
+	case incoming.EditDate > existing.EditDate:
+		r.Updated++
+		r.Changed = append(r.Changed, incoming.ID)
+		return true
+	default:
+		r.Skipped++
+		return false
+	}
+}
+
+// mergeImport returns the imported messages that must be written over the
+// stored ones indexed in existing, counting the outcome of each.
+func mergeImport(existing map[int]ChatMessage, messages []ChatMessage) ([]ChatMessage, ImportResult) {
+	var result ImportResult
+	toStore := make([]ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		var stored *ChatMessage
+		if prev, ok := existing[message.ID]; ok {
+			stored = &prev
+		}
+		if result.merge(stored, message) {
+			// A newer edit doesn't bring back a deleted message, and exports
+			// don't carry the image descriptions nor the transcripts
+			if stored != nil {
+				message.Deleted = message.Deleted || stored.Deleted
+				message.Description = stored.Description
+				message.keepBotReactions(stored.Reactions)
+				if stored.MediaType == "voice" || stored.MediaType == "video_note" {
+					message.Text = stored.Text
+				}
+			}
+			toStore = append(toStore, message)
+			existing[message.ID] = message
+		}
+	}
+	return toStore, result
+}
+
+// Storage backends selectable through STORAGE_BACKEND
+const (
+	StorageBackendRedis  = "redis"
+	StorageBackendMemory = "memory"
+	StorageBackendSQLite = "sqlite"
+)
+
+// NewChatStore creates the chat store for the configured backend
+func NewChatStore(config Config) (ChatStore, error) {
+	switch config.StorageBackend {
+	case StorageBackendRedis:
+		return NewChatStorage(config), nil
+	case StorageBackendMemory:
+		return NewMemoryChatStorage(), nil
+	case StorageBackendSQLite:
+		return NewSQLiteChatStorage(config.SQLitePath)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.StorageBackend)
+	}
+}
+
 type ChatState struct {
 	Messages []ChatMessage
 	Prompt   string
@@ -25,6 +137,56 @@ type TextEntityRef struct {
 	Href string `json:"href,omitempty"`
 }
 
+// ChatReaction is an emoji reaction to a message
+type ChatReaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count,omitempty"`
+	FromBot bool   `json:"from_bot,omitempty"`
+}
+
+// SetBotReaction replaces the bot's reaction to the message, an empty emoji removes it
+func (m *ChatMessage) SetBotReaction(emoji string) {
+	reactions := make([]ChatReaction, 0, len(m.Reactions)+1)
+	for _, reaction := range m.Reactions {
+		if !reaction.FromBot {
+			reactions = append(reactions, reaction)
+		}
+	}
+	if emoji != "" {
+		reactions = append(reactions, ChatReaction{Emoji: emoji, Count: 1, FromBot: true})
+	}
+	m.Reactions = reactions
+}
+
+// keepBotReactions restores the reactions of the bot among stored, which exports
+// list as plain reactions: the imported copy of each is replaced by the original
+func (m *ChatMessage) keepBotReactions(stored []ChatReaction) {
+	for _, own := range stored {
+		if !own.FromBot {
+			continue
+		}
+		if i := slices.IndexFunc(m.Reactions, func(r ChatReaction) bool {
+			return !r.FromBot && r.Emoji == own.Emoji && r.Count <= 1
+		}); i >= 0 {
+			m.Reactions = slices.Delete(m.Reactions, i, i+1)
+		}
+		m.Reactions = append(m.Reactions, own)
+	}
+}
+
+// ApplyEdit replaces the content of the message with its edited version,
+// keeping what edits don't carry such as reactions and transcripts
+func (m *ChatMessage) ApplyEdit(msg models.Message) {
+	edited := FromTelegramMessage(msg)
+	edited.Reactions = m.Reactions
+	edited.Deleted = m.Deleted
+	edited.Description = m.Description
+	if msg.Voice != nil || msg.VideoNote != nil {
+		edited.Text = m.Text
+	}
+	*m = edited
+}
+
 type ChatMessage struct {
 	// Message metadata
 	ID       int    `json:"id"`
@@ -44,13 +206,29 @@ type ChatMessage struct {
 	File      string `json:"file,omitempty"`
 	Caption   string `json:"caption,omitempty"`
 
+	// Media metadata, kept as context for the prompts
+	MimeType string `json:"mime_type,omitempty"`
+	Duration int    `json:"duration,omitempty"` // Seconds, for audio and video
+	Emoji    string `json:"emoji,omitempty"`    // Emoji of a sticker
+	Title    string `json:"title,omitempty"`    // Performer and title of a song
+
+	// Description of an image generated by the vision model
+	Description string `json:"description,omitempty"`
+
 	// Original message references
 	IsFromBot bool `json:"is_from_bot,omitempty"`
 
+	// Emoji reactions to the message
+	Reactions []ChatReaction `json:"reactions,omitempty"`
+
+	// Deleted messages are kept in storage but left out of prompts and exports
+	Deleted bool `json:"deleted,omitempty"`
+
 	// Preserve original formats for export compatibility
 	OriginalEntities []TextEntityRef `json:"entities,omitempty"`
 }
 
+// ChatStorage is the Redis-backed ChatStore
 type ChatStorage struct {
 	client *redis.Client
 	ctx    context.Context
@@ -72,8 +250,8 @@ func NewChatStorage(config Config) *ChatStorage {
 const defaultPrompt = ""
 
 // Chat keys in Redis
-func (cs *ChatStorage) getChatKey(chatID int64) string {
-	return fmt.Sprintf("chat:%d", chatID)
+func (cs *ChatStorage) getMessagesKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:messages", chatID)
 }
 
 func (cs *ChatStorage) getPromptKey(chatID int64) string {
@@ -84,6 +262,22 @@ func (cs *ChatStorage) getSummaryKey(chatID int64) string {
 	return fmt.Sprintf("chat:%d:summary", chatID)
 }
 
+func (cs *ChatStorage) getSettingsKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:settings", chatID)
+}
+
+func (cs *ChatStorage) getMemoriesKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:memories", chatID)
+}
+
+func (cs *ChatStorage) getEmbeddingsKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:embeddings", chatID)
+}
+
+func (cs *ChatStorage) getPendingImportKey(token string) string {
+	return "import:" + token
+}
+
 // FromTelegramMessage converts a Telegram models.Message to our internal ChatMessage
 func FromTelegramMessage(msg models.Message) ChatMessage {
 	chatMsg := ChatMessage{
@@ -114,20 +308,39 @@ func FromTelegramMessage(msg models.Message) ChatMessage {
 		chatMsg.Caption = msg.Caption
 	}
 
-	// Handle media types
+	// Handle media types, animations also carry a document so they come first
 	if len(msg.Photo) > 0 {
 		chatMsg.MediaType = "photo"
+	} else if msg.Animation != nil {
+		chatMsg.MediaType = "animation"
+		chatMsg.File = msg.Animation.FileName
+		chatMsg.MimeType = msg.Animation.MimeType
+		chatMsg.Duration = msg.Animation.Duration
 	} else if msg.Video != nil {
 		chatMsg.MediaType = "video"
+		chatMsg.File = msg.Video.FileName
+		chatMsg.MimeType = msg.Video.MimeType
+		chatMsg.Duration = msg.Video.Duration
+	} else if msg.VideoNote != nil {
+		chatMsg.MediaType = "video_note"
+		chatMsg.Duration = msg.VideoNote.Duration
+	} else if msg.Voice != nil {
+		chatMsg.MediaType = "voice"
+		chatMsg.MimeType = msg.Voice.MimeType
+		chatMsg.Duration = msg.Voice.Duration
 	} else if msg.Audio != nil {
 		chatMsg.MediaType = "audio"
+		chatMsg.File = msg.Audio.FileName
+		chatMsg.MimeType = msg.Audio.MimeType
+		chatMsg.Duration = msg.Audio.Duration
+		chatMsg.Title = songTitle(msg.Audio.Performer, msg.Audio.Title)
 	} else if msg.Document != nil {
 		chatMsg.MediaType = "document"
-		if msg.Document.FileName != "" {
-			chatMsg.File = msg.Document.FileName
-		}
+		chatMsg.File = msg.Document.FileName
+		chatMsg.MimeType = msg.Document.MimeType
 	} else if msg.Sticker != nil {
 		chatMsg.MediaType = "sticker"
+		chatMsg.Emoji = msg.Sticker.Emoji
 	}
 
 	// Handle text entities
@@ -179,11 +392,34 @@ func FromExportMessage(msg ChatExportMessage) ChatMessage {
 		chatMsg.EditDate = msg.EditedUnixtime
 	}
 
-	// Handle media types
-	if msg.MediaType != "" {
+	// Handle media types, exports have no media type for photos and plain files
+	switch {
+	case msg.MediaType != "":
 		chatMsg.MediaType = msg.MediaType
-		if msg.FileName != "" {
-			chatMsg.File = msg.FileName
+		for mediaType, exportType := range exportMediaTypes {
+			if msg.MediaType == exportType {
+				chatMsg.MediaType = mediaType
+			}
+		}
+	case msg.Photo != "":
+		chatMsg.MediaType = "photo"
+	case msg.File != "":
+		chatMsg.MediaType = "document"
+	}
+	chatMsg.File = msg.FileName
+	if chatMsg.File == "" && chatMsg.MediaType == "document" && !strings.HasPrefix(msg.File, "(") {
+		// Archives include the files, their path tells at least the name
+		chatMsg.File = path.Base(msg.File)
+	}
+	chatMsg.MimeType = msg.MimeType
+	chatMsg.Duration = msg.DurationSeconds
+	chatMsg.Emoji = msg.StickerEmoji
+	chatMsg.Title = songTitle(msg.Performer, msg.Title)
+
+	// Convert emoji reactions, custom emoji and paid reactions have no emoji to show
+	for _, reaction := range msg.Reactions {
+		if reaction.Type == "emoji" && reaction.Emoji != "" {
+			chatMsg.Reactions = append(chatMsg.Reactions, ChatReaction{Emoji: reaction.Emoji, Count: reaction.Count})
 		}
 	}
 
@@ -203,6 +439,18 @@ func FromExportMessage(msg ChatExportMessage) ChatMessage {
 	return chatMsg
 }
 
+// songTitle joins the performer and the title of a song, either may be missing
+func songTitle(performer, title string) string {
+	switch {
+	case performer == "":
+		return title
+	case title == "":
+		return performer
+	default:
+		return performer + " - " + title
+	}
+}
+
 // Helper to extract text content from the flexible text field
 func getTextContent(text any) string {
 	if text == nil {
@@ -218,7 +466,9 @@ func getTextContent(text any) string {
 	if entities, ok := text.([]any); ok {
 		var result string
 		for _, entity := range entities {
-			if entityMap, ok := entity.(map[string]any); ok {
+			if textStr, ok := entity.(string); ok {
+				result += textStr
+			} else if entityMap, ok := entity.(map[string]any); ok {
 				if textStr, ok := entityMap["text"].(string); ok {
 					result += textStr
 				}
@@ -246,72 +496,134 @@ func ConvertExportMessages(exportMessages []ChatExportMessage) []ChatMessage {
 	return result
 }
 
-func (cs *ChatStorage) ImportChat(chatID int64, messages []ChatMessage) error {
-	// Sort messages by ID before storing
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].ID < messages[j].ID
-	})
+// storeMessagesPipe queues the commands that upsert messages into the chat's
+// sorted set. Any previous entry with the same message ID is replaced.
+func (cs *ChatStorage) storeMessagesPipe(pipe redis.Pipeliner, chatID int64, messages []ChatMessage) error {
+	key := cs.getMessagesKey(chatID)
+	for _, message := range messages {
+		messageJSON, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message %d: %w", message.ID, err)
+		}
+		score := strconv.Itoa(message.ID)
+		pipe.ZRemRangeByScore(cs.ctx, key, score, score)
+		pipe.ZAdd(cs.ctx, key, redis.Z{Score: float64(message.ID), Member: messageJSON})
+	}
+	return nil
+}
 
-	// Serialize messages to JSON
-	messagesJSON, err := json.Marshal(messages)
-	if err != nil {
-		return fmt.Errorf("failed to marshal messages: %w", err)
+func (cs *ChatStorage) ImportChat(chatID int64, messages []ChatMessage, opts ImportOptions) (ImportResult, error) {
+	// Index the stored history to merge into it
+	existing := make(map[int]ChatMessage)
+	if !opts.Replace {
+		messagesJSON, err := cs.client.ZRange(cs.ctx, cs.getMessagesKey(chatID), 0, -1).Result()
+		if err != nil {
+			return ImportResult{}, fmt.Errorf("failed to get messages: %w", err)
+		}
+		for _, messageJSON := range messagesJSON {
+			var message ChatMessage
+			if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+				return ImportResult{}, fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			existing[message.ID] = message
+		}
 	}
 
+	toStore, result := mergeImport(existing, messages)
+
 	// Store in Redis with a transaction
-	pipe := cs.client.Pipeline()
-	pipe.Set(cs.ctx, cs.getChatKey(chatID), messagesJSON, 0)
-	pipe.Set(cs.ctx, cs.getPromptKey(chatID), defaultPrompt, 0)
-	pipe.Set(cs.ctx, cs.getSummaryKey(chatID), "", 0)
-	_, err = pipe.Exec(cs.ctx)
-	if err != nil {
-		return fmt.Errorf("failed to store chat in Redis: %w", err)
+	pipe := cs.client.TxPipeline()
+	if opts.Replace {
+		// Embeddings belong to the replaced messages
+		pipe.Del(cs.ctx, cs.getMessagesKey(chatID), cs.getEmbeddingsKey(chatID))
+	}
+	if err := cs.storeMessagesPipe(pipe, chatID, toStore); err != nil {
+		return result, err
+	}
+	if opts.ResetPrompt {
+		pipe.Set(cs.ctx, cs.getPromptKey(chatID), defaultPrompt, 0)
+	}
+	if opts.ResetSummary {
+		pipe.Set(cs.ctx, cs.getSummaryKey(chatID), "", 0)
+	}
+	if _, err := pipe.Exec(cs.ctx); err != nil {
+		return result, fmt.Errorf("failed to store chat in Redis: %w", err)
 	}
 
-	return nil
+	return result, nil
 }
 
 func (cs *ChatStorage) StoreMessage(chatID int64, message models.Message) error {
 	// Convert Telegram message to our ChatMessage format
 	chatMessage := FromTelegramMessage(message)
 
-	// Get existing messages
-	chatState, found, err := cs.getChatStateInternal(chatID)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve chat state: %w", err)
+	pipe := cs.client.TxPipeline()
+	if err := cs.storeMessagesPipe(pipe, chatID, []ChatMessage{chatMessage}); err != nil {
+		return err
+	}
+	if _, err := pipe.Exec(cs.ctx); err != nil {
+		return fmt.Errorf("failed to store message in Redis: %w", err)
 	}
 
-	if !found {
-		chatState = ChatState{
-			Messages: []ChatMessage{},
-			Prompt:   defaultPrompt,
-			Summary:  "",
+	return nil
+}
+
+// UpdateMessage applies update to the stored message with messageID, returning
+// false if the message isn't stored
+func (cs *ChatStorage) UpdateMessage(chatID int64, messageID int, update func(*ChatMessage)) (bool, error) {
+	key := cs.getMessagesKey(chatID)
+	score := strconv.Itoa(messageID)
+	found := false
+
+	// Optimistic transaction, retried when the history changes in the meantime
+	txf := func(tx *redis.Tx) error {
+		messagesJSON, err := tx.ZRangeByScore(cs.ctx, key, &redis.ZRangeBy{Min: score, Max: score}).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get message: %w", err)
+		}
+		if len(messagesJSON) == 0 {
+			return nil
 		}
-	}
 
-	// Add the new message
-	chatState.Messages = append(chatState.Messages, chatMessage)
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(messagesJSON[0]), &message); err != nil {
+			return fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		update(&message)
+		found = true
 
-	// Sort messages by ID to maintain chronological order
-	sort.Slice(chatState.Messages, func(i, j int) bool {
-		return chatState.Messages[i].ID < chatState.Messages[j].ID
-	})
+		_, err = tx.TxPipelined(cs.ctx, func(pipe redis.Pipeliner) error {
+			return cs.storeMessagesPipe(pipe, chatID, []ChatMessage{message})
+		})
+		return err
+	}
 
-	// Serialize and store messages
-	messagesJSON, err := json.Marshal(chatState.Messages)
+	var err error
+	for range 3 {
+		found = false
+		if err = cs.client.Watch(cs.ctx, txf, key); !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal messages: %w", err)
+		return false, fmt.Errorf("failed to update message %d: %w", messageID, err)
 	}
 
-	return cs.client.Set(cs.ctx, cs.getChatKey(chatID), messagesJSON, 0).Err()
+	return found, nil
 }
 
-// Internal method to get chat state
-func (cs *ChatStorage) getChatStateInternal(chatID int64) (ChatState, bool, error) {
+// Internal method to get chat state. Only the last limit messages are read,
+// a limit <= 0 reads the whole history.
+func (cs *ChatStorage) getChatStateInternal(chatID int64, limit int) (ChatState, bool, error) {
+	start := int64(0)
+	if limit > 0 {
+		start = -int64(limit)
+	}
+
 	pipe := cs.client.Pipeline()
 
 	// Get all components of the chat state in one round trip
-	messagesCmd := pipe.Get(cs.ctx, cs.getChatKey(chatID))
+	messagesCmd := pipe.ZRange(cs.ctx, cs.getMessagesKey(chatID), start, -1)
 	promptCmd := pipe.Get(cs.ctx, cs.getPromptKey(chatID))
 	summaryCmd := pipe.Get(cs.ctx, cs.getSummaryKey(chatID))
 
@@ -330,15 +642,20 @@ func (cs *ChatStorage) getChatStateInternal(chatID int64) (ChatState, bool, erro
 	// Check if at least messages exist
 	messagesJSON, err := messagesCmd.Result()
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return chatState, false, nil
-		}
 		return chatState, false, fmt.Errorf("failed to get messages: %w", err)
 	}
+	if len(messagesJSON) == 0 {
+		return chatState, false, nil
+	}
 
-	// Unmarshal messages
-	if err := json.Unmarshal([]byte(messagesJSON), &chatState.Messages); err != nil {
-		return chatState, false, fmt.Errorf("failed to unmarshal messages: %w", err)
+	// Unmarshal messages, already ordered by ID through the set score
+	chatState.Messages = make([]ChatMessage, 0, len(messagesJSON))
+	for _, messageJSON := range messagesJSON {
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			return chatState, false, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		chatState.Messages = append(chatState.Messages, message)
 	}
 
 	// Get prompt if available
@@ -356,8 +673,10 @@ func (cs *ChatStorage) getChatStateInternal(chatID int64) (ChatState, bool, erro
 	return chatState, true, nil
 }
 
-func (cs *ChatStorage) GetChatState(chatID int64) (ChatState, bool) {
-	chatState, found, err := cs.getChatStateInternal(chatID)
+// GetChatState returns the prompt, the summary and the last limit messages of
+// the chat. A limit <= 0 returns the whole history.
+func (cs *ChatStorage) GetChatState(chatID int64, limit int) (ChatState, bool) {
+	chatState, found, err := cs.getChatStateInternal(chatID, limit)
 	if err != nil {
 		// Log error but return empty state
 		fmt.Printf("Error getting chat state: %v\n", err)
@@ -375,6 +694,216 @@ func (cs *ChatStorage) SetSummary(chatID int64, summary string) error {
 	return cs.client.Set(cs.ctx, cs.getSummaryKey(chatID), summary, 0).Err()
 }
 
+func (cs *ChatStorage) GetSettings(chatID int64) (ChatSettings, error) {
+	var settings ChatSettings
+	settingsJSON, err := cs.client.Get(cs.ctx, cs.getSettingsKey(chatID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, fmt.Errorf("failed to get settings: %w", err)
+	}
+	if err := json.Unmarshal([]byte(settingsJSON), &settings); err != nil {
+		return settings, fmt.Errorf("failed to unmarshal settings: %w", err)
+	}
+	return settings, nil
+}
+
+func (cs *ChatStorage) SetSettings(chatID int64, settings ChatSettings) error {
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settings: %w", err)
+	}
+	return cs.client.Set(cs.ctx, cs.getSettingsKey(chatID), settingsJSON, 0).Err()
+}
+
+func (cs *ChatStorage) GetMemories(chatID int64) (ChatMemories, error) {
+	var memories ChatMemories
+	memoriesJSON, err := cs.client.Get(cs.ctx, cs.getMemoriesKey(chatID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return memories, nil
+	}
+	if err != nil {
+		return memories, fmt.Errorf("failed to get memories: %w", err)
+	}
+	if err := json.Unmarshal([]byte(memoriesJSON), &memories); err != nil {
+		return memories, fmt.Errorf("failed to unmarshal memories: %w", err)
+	}
+	return memories, nil
+}
+
+func (cs *ChatStorage) SetMemories(chatID int64, memories ChatMemories) error {
+	memoriesJSON, err := json.Marshal(memories)
+	if err != nil {
+		return fmt.Errorf("failed to marshal memories: %w", err)
+	}
+	return cs.client.Set(cs.ctx, cs.getMemoriesKey(chatID), memoriesJSON, 0).Err()
+}
+
+// GetMessagesByID returns the stored messages with the given IDs, ordered by ID
+func (cs *ChatStorage) GetMessagesByID(chatID int64, ids []int) ([]ChatMessage, error) {
+	key := cs.getMessagesKey(chatID)
+	ids = slices.Sorted(slices.Values(ids))
+
+	pipe := cs.client.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(ids))
+	for i, id := range ids {
+		score := strconv.Itoa(id)
+		cmds[i] = pipe.ZRangeByScore(cs.ctx, key, &redis.ZRangeBy{Min: score, Max: score})
+	}
+	if _, err := pipe.Exec(cs.ctx); err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+
+	messages := make([]ChatMessage, 0, len(ids))
+	for _, cmd := range cmds {
+		for _, messageJSON := range cmd.Val() {
+			var message ChatMessage
+			if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// GetMessagesAfter returns up to limit stored messages with an ID above afterID, ordered by ID
+func (cs *ChatStorage) GetMessagesAfter(chatID int64, afterID, limit int) ([]ChatMessage, error) {
+	messagesJSON, err := cs.client.ZRangeByScore(cs.ctx, cs.getMessagesKey(chatID), &redis.ZRangeBy{
+		Min:   "(" + strconv.Itoa(afterID),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+
+	messages := make([]ChatMessage, 0, len(messagesJSON))
+	for _, messageJSON := range messagesJSON {
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// GetEmbeddings returns the embeddings of the messages of the chat by message ID
+func (cs *ChatStorage) GetEmbeddings(chatID int64) (map[int][]float32, error) {
+	fields, err := cs.client.HGetAll(cs.ctx, cs.getEmbeddingsKey(chatID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get embeddings: %w", err)
+	}
+
+	embeddings := make(map[int][]float32, len(fields))
+	for field, value := range fields {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		embeddings[id] = decodeEmbedding([]byte(value))
+	}
+	return embeddings, nil
+}
+
+func (cs *ChatStorage) StoreEmbeddings(chatID int64, embeddings map[int][]float32) error {
+	values := make(map[string]any, len(embeddings))
+	for id, embedding := range embeddings {
+		values[strconv.Itoa(id)] = encodeEmbedding(embedding)
+	}
+	return cs.client.HSet(cs.ctx, cs.getEmbeddingsKey(chatID), values).Err()
+}
+
+func (cs *ChatStorage) DeleteEmbeddings(chatID int64, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	fields := make([]string, len(ids))
+	for i, id := range ids {
+		fields[i] = strconv.Itoa(id)
+	}
+	return cs.client.HDel(cs.ctx, cs.getEmbeddingsKey(chatID), fields...).Err()
+}
+
+func (cs *ChatStorage) SetPendingImport(token string, pending PendingImport, ttl time.Duration) error {
+	pendingJSON, err := json.Marshal(pending)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending import: %w", err)
+	}
+	return cs.client.Set(cs.ctx, cs.getPendingImportKey(token), pendingJSON, ttl).Err()
+}
+
+func (cs *ChatStorage) GetPendingImport(token string) (PendingImport, bool, error) {
+	var pending PendingImport
+	pendingJSON, err := cs.client.Get(cs.ctx, cs.getPendingImportKey(token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return pending, false, nil
+	}
+	if err != nil {
+		return pending, false, fmt.Errorf("failed to get pending import: %w", err)
+	}
+	if err := json.Unmarshal([]byte(pendingJSON), &pending); err != nil {
+		return pending, false, fmt.Errorf("failed to unmarshal pending import: %w", err)
+	}
+	return pending, true, nil
+}
+
+// DeletePendingImport drops the pending import, returning false if it was
+// already gone, so that only one confirmation imports it
+func (cs *ChatStorage) DeletePendingImport(token string) (bool, error) {
+	deleted, err := cs.client.Del(cs.ctx, cs.getPendingImportKey(token)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete pending import: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// MigrateLegacyChats converts the old single JSON blob stored under chat:<id>
+// into the per-message sorted set layout and removes the blob. It returns the
+// number of migrated chats and is a no-op once every chat has been converted.
+func (cs *ChatStorage) MigrateLegacyChats() (int, error) {
+	migrated := 0
+	iter := cs.client.ScanType(cs.ctx, 0, "chat:*", 100, "string").Iterator()
+	for iter.Next(cs.ctx) {
+		key := iter.Val()
+
+		// Skip prompt, summary, settings, memories and embeddings keys, only chat:<id> holds the legacy blob
+		chatID, err := strconv.ParseInt(strings.TrimPrefix(key, "chat:"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		messagesJSON, err := cs.client.Get(cs.ctx, key).Result()
+		if err != nil {
+			return migrated, fmt.Errorf("failed to read legacy chat %d: %w", chatID, err)
+		}
+
+		var messages []ChatMessage
+		if err := json.Unmarshal([]byte(messagesJSON), &messages); err != nil {
+			return migrated, fmt.Errorf("failed to unmarshal legacy chat %d: %w", chatID, err)
+		}
+
+		pipe := cs.client.TxPipeline()
+		if err := cs.storeMessagesPipe(pipe, chatID, messages); err != nil {
+			return migrated, err
+		}
+		pipe.Del(cs.ctx, key)
+		if _, err := pipe.Exec(cs.ctx); err != nil {
+			return migrated, fmt.Errorf("failed to migrate legacy chat %d: %w", chatID, err)
+		}
+
+		log.Printf("Migrated %d messages of chat %d to the per-message layout", len(messages), chatID)
+		migrated++
+	}
+	if err := iter.Err(); err != nil {
+		return migrated, fmt.Errorf("failed to scan legacy chats: %w", err)
+	}
+
+	return migrated, nil
+}
+
 // Check if Redis connection is healthy
 func (cs *ChatStorage) Ping() error {
 	ctx, cancel := context.WithTimeout(cs.ctx, 5*time.Second)
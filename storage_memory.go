@@ -0,0 +1,316 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+type memoryChat struct {
+	messages   []ChatMessage
+	prompt     string
+	summary    string
+	settings   ChatSettings
+	memories   ChatMemories
+	embeddings map[int][]float32
+}
+
+// MemoryChatStorage keeps every chat in process memory. Nothing survives a
+// restart, which makes it suitable for tests and throwaway deployments.
+type MemoryChatStorage struct {
+	mu      sync.RWMutex
+	chats   map[int64]*memoryChat
+	imports map[string]memoryPendingImport
+}
+
+type memoryPendingImport struct {
+	pending PendingImport
+	expires time.Time
+}
+
+func NewMemoryChatStorage() *MemoryChatStorage {
+	return &MemoryChatStorage{
+		chats:   make(map[int64]*memoryChat),
+		imports: make(map[string]memoryPendingImport),
+	}
+}
+
+// getChat returns the chat for chatID, creating it if needed. Callers must hold the write lock.
+func (ms *MemoryChatStorage) getChat(chatID int64) *memoryChat {
+	chat, ok := ms.chats[chatID]
+	if !ok {
+		chat = &memoryChat{prompt: defaultPrompt}
+		ms.chats[chatID] = chat
+	}
+	return chat
+}
+
+// upsertMessage inserts message keeping the slice ordered by ID, replacing any
+// previous entry with the same ID.
+func upsertMessage(messages []ChatMessage, message ChatMessage) []ChatMessage {
+	i := sort.Search(len(messages), func(i int) bool {
+		return messages[i].ID >= message.ID
+	})
+	if i < len(messages) && messages[i].ID == message.ID {
+		messages[i] = message
+		return messages
+	}
+	messages = append(messages, ChatMessage{})
+	copy(messages[i+1:], messages[i:])
+	messages[i] = message
+	return messages
+}
+
+// findMessage returns the stored message with id, or nil
+func findMessage(messages []ChatMessage, id int) *ChatMessage {
+	i := sort.Search(len(messages), func(i int) bool {
+		return messages[i].ID >= id
+	})
+	if i < len(messages) && messages[i].ID == id {
+		return &messages[i]
+	}
+	return nil
+}
+
+func (ms *MemoryChatStorage) ImportChat(chatID int64, messages []ChatMessage, opts ImportOptions) (ImportResult, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	chat := ms.getChat(chatID)
+	if opts.Replace {
+		chat.messages = nil
+		chat.embeddings = nil
+	}
+
+	existing := make(map[int]ChatMessage, len(chat.messages))
+	for _, message := range chat.messages {
+		existing[message.ID] = message
+	}
+	toStore, result := mergeImport(existing, messages)
+	for _, message := range toStore {
+		chat.messages = upsertMessage(chat.messages, message)
+	}
+
+	if opts.ResetPrompt {
+		chat.prompt = defaultPrompt
+	}
+	if opts.ResetSummary {
+		chat.summary = ""
+	}
+	return result, nil
+}
+
+func (ms *MemoryChatStorage) StoreMessage(chatID int64, message models.Message) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	chat := ms.getChat(chatID)
+	chat.messages = upsertMessage(chat.messages, FromTelegramMessage(message))
+	return nil
+}
+
+func (ms *MemoryChatStorage) UpdateMessage(chatID int64, messageID int, update func(*ChatMessage)) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	chat, ok := ms.chats[chatID]
+	if !ok {
+		return false, nil
+	}
+	message := findMessage(chat.messages, messageID)
+	if message == nil {
+		return false, nil
+	}
+	update(message)
+	return true, nil
+}
+
+func (ms *MemoryChatStorage) GetChatState(chatID int64, limit int) (ChatState, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	chat, ok := ms.chats[chatID]
+	if !ok || len(chat.messages) == 0 {
+		return ChatState{Messages: []ChatMessage{}, Prompt: defaultPrompt}, false
+	}
+
+	start := 0
+	if limit > 0 {
+		start = max(len(chat.messages)-limit, 0)
+	}
+
+	// Copy so callers can't mutate the stored history
+	messages := make([]ChatMessage, len(chat.messages)-start)
+	copy(messages, chat.messages[start:])
+
+	return ChatState{
+		Messages: messages,
+		Prompt:   chat.prompt,
+		Summary:  chat.summary,
+	}, true
+}
+
+func (ms *MemoryChatStorage) SetPrompt(chatID int64, prompt string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.getChat(chatID).prompt = prompt
+	return nil
+}
+
+func (ms *MemoryChatStorage) SetSummary(chatID int64, summary string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.getChat(chatID).summary = summary
+	return nil
+}
+
+func (ms *MemoryChatStorage) GetSettings(chatID int64) (ChatSettings, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if chat, ok := ms.chats[chatID]; ok {
+		return chat.settings, nil
+	}
+	return ChatSettings{}, nil
+}
+
+func (ms *MemoryChatStorage) SetSettings(chatID int64, settings ChatSettings) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.getChat(chatID).settings = settings
+	return nil
+}
+
+func (ms *MemoryChatStorage) GetMemories(chatID int64) (ChatMemories, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if chat, ok := ms.chats[chatID]; ok {
+		return chat.memories.clone(), nil
+	}
+	return ChatMemories{}, nil
+}
+
+func (ms *MemoryChatStorage) SetMemories(chatID int64, memories ChatMemories) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.getChat(chatID).memories = memories.clone()
+	return nil
+}
+
+func (ms *MemoryChatStorage) GetMessagesByID(chatID int64, ids []int) ([]ChatMessage, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	chat, ok := ms.chats[chatID]
+	if !ok {
+		return nil, nil
+	}
+	var messages []ChatMessage
+	for _, id := range slices.Sorted(slices.Values(ids)) {
+		if message := findMessage(chat.messages, id); message != nil {
+			messages = append(messages, *message)
+		}
+	}
+	return messages, nil
+}
+
+func (ms *MemoryChatStorage) GetMessagesAfter(chatID int64, afterID, limit int) ([]ChatMessage, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	chat, ok := ms.chats[chatID]
+	if !ok {
+		return nil, nil
+	}
+	start := sort.Search(len(chat.messages), func(i int) bool {
+		return chat.messages[i].ID > afterID
+	})
+	end := min(start+limit, len(chat.messages))
+	return slices.Clone(chat.messages[start:end]), nil
+}
+
+func (ms *MemoryChatStorage) GetEmbeddings(chatID int64) (map[int][]float32, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	embeddings := make(map[int][]float32)
+	if chat, ok := ms.chats[chatID]; ok {
+		maps.Copy(embeddings, chat.embeddings)
+	}
+	return embeddings, nil
+}
+
+func (ms *MemoryChatStorage) StoreEmbeddings(chatID int64, embeddings map[int][]float32) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	chat := ms.getChat(chatID)
+	if chat.embeddings == nil {
+		chat.embeddings = make(map[int][]float32)
+	}
+	maps.Copy(chat.embeddings, embeddings)
+	return nil
+}
+
+func (ms *MemoryChatStorage) DeleteEmbeddings(chatID int64, ids []int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if chat, ok := ms.chats[chatID]; ok {
+		for _, id := range ids {
+			delete(chat.embeddings, id)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryChatStorage) SetPendingImport(token string, pending PendingImport, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	for key, p := range ms.imports {
+		if now.After(p.expires) {
+			delete(ms.imports, key)
+		}
+	}
+	ms.imports[token] = memoryPendingImport{pending: pending, expires: now.Add(ttl)}
+	return nil
+}
+
+func (ms *MemoryChatStorage) GetPendingImport(token string) (PendingImport, bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	p, ok := ms.imports[token]
+	if !ok || time.Now().After(p.expires) {
+		return PendingImport{}, false, nil
+	}
+	return p.pending, true, nil
+}
+
+func (ms *MemoryChatStorage) DeletePendingImport(token string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	p, ok := ms.imports[token]
+	delete(ms.imports, token)
+	return ok && !time.Now().After(p.expires), nil
+}
+
+func (ms *MemoryChatStorage) Ping() error {
+	return nil
+}
+
+func (ms *MemoryChatStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS chats (
+	chat_id INTEGER PRIMARY KEY,
+	prompt  TEXT NOT NULL DEFAULT '',
+	summary TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS messages (
+	chat_id    INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	data       TEXT NOT NULL,
+	PRIMARY KEY (chat_id, message_id)
+);
+CREATE TABLE IF NOT EXISTS chat_settings (
+	chat_id INTEGER PRIMARY KEY,
+	data    TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS chat_memories (
+	chat_id INTEGER PRIMARY KEY,
+	data    TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS message_embeddings (
+	chat_id    INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	vector     BLOB NOT NULL,
+	PRIMARY KEY (chat_id, message_id)
+);
+CREATE TABLE IF NOT EXISTS pending_imports (
+	token   TEXT PRIMARY KEY,
+	data    TEXT NOT NULL,
+	expires INTEGER NOT NULL
+);
+`
+
+// SQLiteChatStorage stores chats in an embedded SQLite database file.
+type SQLiteChatStorage struct {
+	db  *sql.DB
+	ctx context.Context
+}
+
+func NewSQLiteChatStorage(path string) (*SQLiteChatStorage, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+
+	// SQLite allows a single writer, avoid lock contention between connections
+	db.SetMaxOpenConns(1)
+
+	ss := &SQLiteChatStorage{
+		db:  db,
+		ctx: context.Background(),
+	}
+	if _, err := db.ExecContext(ss.ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create SQLite schema: %w", err)
+	}
+
+	return ss, nil
+}
+
+// upsertMessages writes messages inside tx, replacing entries with the same ID.
+func (ss *SQLiteChatStorage) upsertMessages(tx *sql.Tx, chatID int64, messages []ChatMessage) error {
+	stmt, err := tx.PrepareContext(ss.ctx,
+		`INSERT OR REPLACE INTO messages (chat_id, message_id, data) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare message insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, message := range messages {
+		messageJSON, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message %d: %w", message.ID, err)
+		}
+		if _, err := stmt.ExecContext(ss.ctx, chatID, message.ID, string(messageJSON)); err != nil {
+			return fmt.Errorf("failed to store message %d: %w", message.ID, err)
+		}
+	}
+	return nil
+}
+
+func (ss *SQLiteChatStorage) ImportChat(chatID int64, messages []ChatMessage, opts ImportOptions) (ImportResult, error) {
+	tx, err := ss.db.BeginTx(ss.ctx, nil)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if opts.Replace {
+		if _, err := tx.ExecContext(ss.ctx, `DELETE FROM messages WHERE chat_id = ?`, chatID); err != nil {
+			return ImportResult{}, fmt.Errorf("failed to clear chat history: %w", err)
+		}
+		// Embeddings belong to the replaced messages
+		if _, err := tx.ExecContext(ss.ctx, `DELETE FROM message_embeddings WHERE chat_id = ?`, chatID); err != nil {
+			return ImportResult{}, fmt.Errorf("failed to clear embeddings: %w", err)
+		}
+	}
+
+	// Index the stored history to merge into it
+	existing := make(map[int]ChatMessage)
+	rows, err := tx.QueryContext(ss.ctx, `SELECT data FROM messages WHERE chat_id = ?`, chatID)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("failed to query messages: %w", err)
+	}
+	for rows.Next() {
+		var messageJSON string
+		var message ChatMessage
+		if err := rows.Scan(&messageJSON); err != nil {
+			rows.Close()
+			return ImportResult{}, fmt.Errorf("failed to scan message: %w", err)
+		}
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			rows.Close()
+			return ImportResult{}, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		existing[message.ID] = message
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ImportResult{}, fmt.Errorf("failed to read messages: %w", err)
+	}
+
+	toStore, result := mergeImport(existing, messages)
+
+	if err := ss.upsertMessages(tx, chatID, toStore); err != nil {
+		return result, err
+	}
+	if opts.ResetPrompt {
+		if _, err := tx.ExecContext(ss.ctx, `UPDATE chats SET prompt = ? WHERE chat_id = ?`, defaultPrompt, chatID); err != nil {
+			return result, fmt.Errorf("failed to reset prompt: %w", err)
+		}
+	}
+	if opts.ResetSummary {
+		if _, err := tx.ExecContext(ss.ctx, `UPDATE chats SET summary = '' WHERE chat_id = ?`, chatID); err != nil {
+			return result, fmt.Errorf("failed to reset summary: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to store chat in SQLite: %w", err)
+	}
+	return result, nil
+}
+
+func (ss *SQLiteChatStorage) StoreMessage(chatID int64, message models.Message) error {
+	tx, err := ss.db.BeginTx(ss.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := ss.upsertMessages(tx, chatID, []ChatMessage{FromTelegramMessage(message)}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *SQLiteChatStorage) UpdateMessage(chatID int64, messageID int, update func(*ChatMessage)) (bool, error) {
+	tx, err := ss.db.BeginTx(ss.ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var messageJSON string
+	err = tx.QueryRowContext(ss.ctx,
+		`SELECT data FROM messages WHERE chat_id = ? AND message_id = ?`, chatID, messageID,
+	).Scan(&messageJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get message: %w", err)
+	}
+
+	var message ChatMessage
+	if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+		return false, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	update(&message)
+
+	if err := ss.upsertMessages(tx, chatID, []ChatMessage{message}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to update message %d: %w", messageID, err)
+	}
+	return true, nil
+}
+
+// Internal method to get chat state
+func (ss *SQLiteChatStorage) getChatStateInternal(chatID int64, limit int) (ChatState, bool, error) {
+	chatState := ChatState{
+		Messages: []ChatMessage{},
+		Prompt:   defaultPrompt,
+		Summary:  "",
+	}
+
+	// A negative LIMIT means no limit in SQLite
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := ss.db.QueryContext(ss.ctx, `
+		SELECT data FROM (
+			SELECT message_id, data FROM messages
+			WHERE chat_id = ?
+			ORDER BY message_id DESC
+			LIMIT ?
+		) ORDER BY message_id ASC`, chatID, limit)
+	if err != nil {
+		return chatState, false, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageJSON string
+		if err := rows.Scan(&messageJSON); err != nil {
+			return chatState, false, fmt.Errorf("failed to scan message: %w", err)
+		}
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			return chatState, false, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		chatState.Messages = append(chatState.Messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return chatState, false, fmt.Errorf("failed to read messages: %w", err)
+	}
+
+	if len(chatState.Messages) == 0 {
+		return chatState, false, nil
+	}
+
+	err = ss.db.QueryRowContext(ss.ctx,
+		`SELECT prompt, summary FROM chats WHERE chat_id = ?`, chatID,
+	).Scan(&chatState.Prompt, &chatState.Summary)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return chatState, false, fmt.Errorf("failed to get chat settings: %w", err)
+	}
+
+	return chatState, true, nil
+}
+
+func (ss *SQLiteChatStorage) GetChatState(chatID int64, limit int) (ChatState, bool) {
+	chatState, found, err := ss.getChatStateInternal(chatID, limit)
+	if err != nil {
+		// Log error but return empty state
+		fmt.Printf("Error getting chat state: %v\n", err)
+		return ChatState{}, false
+	}
+
+	return chatState, found
+}
+
+func (ss *SQLiteChatStorage) SetPrompt(chatID int64, prompt string) error {
+	_, err := ss.db.ExecContext(ss.ctx, `
+		INSERT INTO chats (chat_id, prompt) VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET prompt = excluded.prompt`, chatID, prompt)
+	return err
+}
+
+func (ss *SQLiteChatStorage) SetSummary(chatID int64, summary string) error {
+	_, err := ss.db.ExecContext(ss.ctx, `
+		INSERT INTO chats (chat_id, summary) VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET summary = excluded.summary`, chatID, summary)
+	return err
+}
+
+func (ss *SQLiteChatStorage) GetSettings(chatID int64) (ChatSettings, error) {
+	var settings ChatSettings
+	var settingsJSON string
+	err := ss.db.QueryRowContext(ss.ctx, `SELECT data FROM chat_settings WHERE chat_id = ?`, chatID).Scan(&settingsJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, fmt.Errorf("failed to get settings: %w", err)
+	}
+	if err := json.Unmarshal([]byte(settingsJSON), &settings); err != nil {
+		return settings, fmt.Errorf("failed to unmarshal settings: %w", err)
+	}
+	return settings, nil
+}
+
+func (ss *SQLiteChatStorage) SetSettings(chatID int64, settings ChatSettings) error {
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settings: %w", err)
+	}
+	_, err = ss.db.ExecContext(ss.ctx, `
+		INSERT INTO chat_settings (chat_id, data) VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET data = excluded.data`, chatID, string(settingsJSON))
+	return err
+}
+
+func (ss *SQLiteChatStorage) GetMemories(chatID int64) (ChatMemories, error) {
+	var memories ChatMemories
+	var memoriesJSON string
+	err := ss.db.QueryRowContext(ss.ctx, `SELECT data FROM chat_memories WHERE chat_id = ?`, chatID).Scan(&memoriesJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return memories, nil
+	}
+	if err != nil {
+		return memories, fmt.Errorf("failed to get memories: %w", err)
+	}
+	if err := json.Unmarshal([]byte(memoriesJSON), &memories); err != nil {
+		return memories, fmt.Errorf("failed to unmarshal memories: %w", err)
+	}
+	return memories, nil
+}
+
+func (ss *SQLiteChatStorage) SetMemories(chatID int64, memories ChatMemories) error {
+	memoriesJSON, err := json.Marshal(memories)
+	if err != nil {
+		return fmt.Errorf("failed to marshal memories: %w", err)
+	}
+	_, err = ss.db.ExecContext(ss.ctx, `
+		INSERT INTO chat_memories (chat_id, data) VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET data = excluded.data`, chatID, string(memoriesJSON))
+	return err
+}
+
+func (ss *SQLiteChatStorage) GetMessagesByID(chatID int64, ids []int) ([]ChatMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := []any{chatID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := ss.db.QueryContext(ss.ctx, `
+		SELECT data FROM messages
+		WHERE chat_id = ? AND message_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		ORDER BY message_id ASC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		var messageJSON string
+		if err := rows.Scan(&messageJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (ss *SQLiteChatStorage) GetMessagesAfter(chatID int64, afterID, limit int) ([]ChatMessage, error) {
+	rows, err := ss.db.QueryContext(ss.ctx, `
+		SELECT data FROM messages
+		WHERE chat_id = ? AND message_id > ?
+		ORDER BY message_id ASC LIMIT ?`, chatID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		var messageJSON string
+		if err := rows.Scan(&messageJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (ss *SQLiteChatStorage) GetEmbeddings(chatID int64) (map[int][]float32, error) {
+	rows, err := ss.db.QueryContext(ss.ctx, `SELECT message_id, vector FROM message_embeddings WHERE chat_id = ?`, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query embeddings: %w", err)
+	}
+	defer rows.Close()
+
+	embeddings := make(map[int][]float32)
+	for rows.Next() {
+		var id int
+		var vector []byte
+		if err := rows.Scan(&id, &vector); err != nil {
+			return nil, fmt.Errorf("failed to scan embedding: %w", err)
+		}
+		embeddings[id] = decodeEmbedding(vector)
+	}
+	return embeddings, rows.Err()
+}
+
+func (ss *SQLiteChatStorage) StoreEmbeddings(chatID int64, embeddings map[int][]float32) error {
+	tx, err := ss.db.BeginTx(ss.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for id, embedding := range embeddings {
+		if _, err := tx.ExecContext(ss.ctx, `
+			INSERT INTO message_embeddings (chat_id, message_id, vector) VALUES (?, ?, ?)
+			ON CONFLICT (chat_id, message_id) DO UPDATE SET vector = excluded.vector`,
+			chatID, id, encodeEmbedding(embedding)); err != nil {
+			return fmt.Errorf("failed to store embedding of message %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (ss *SQLiteChatStorage) DeleteEmbeddings(chatID int64, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := []any{chatID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := ss.db.ExecContext(ss.ctx, `
+		DELETE FROM message_embeddings
+		WHERE chat_id = ? AND message_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	return err
+}
+
+func (ss *SQLiteChatStorage) SetPendingImport(token string, pending PendingImport, ttl time.Duration) error {
+	pendingJSON, err := json.Marshal(pending)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending import: %w", err)
+	}
+	now := time.Now()
+	if _, err := ss.db.ExecContext(ss.ctx, `DELETE FROM pending_imports WHERE expires < ?`, now.Unix()); err != nil {
+		return fmt.Errorf("failed to clear expired imports: %w", err)
+	}
+	_, err = ss.db.ExecContext(ss.ctx, `
+		INSERT OR REPLACE INTO pending_imports (token, data, expires) VALUES (?, ?, ?)`,
+		token, string(pendingJSON), now.Add(ttl).Unix())
+	return err
+}
+
+func (ss *SQLiteChatStorage) GetPendingImport(token string) (PendingImport, bool, error) {
+	var pending PendingImport
+	var pendingJSON string
+	err := ss.db.QueryRowContext(ss.ctx, `
+		SELECT data FROM pending_imports WHERE token = ? AND expires >= ?`,
+		token, time.Now().Unix()).Scan(&pendingJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pending, false, nil
+	}
+	if err != nil {
+		return pending, false, fmt.Errorf("failed to get pending import: %w", err)
+	}
+	if err := json.Unmarshal([]byte(pendingJSON), &pending); err != nil {
+		return pending, false, fmt.Errorf("failed to unmarshal pending import: %w", err)
+	}
+	return pending, true, nil
+}
+
+func (ss *SQLiteChatStorage) DeletePendingImport(token string) (bool, error) {
+	res, err := ss.db.ExecContext(ss.ctx, `
+		DELETE FROM pending_imports WHERE token = ? AND expires >= ?`, token, time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("failed to delete pending import: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	return deleted > 0, err
+}
+
+// Check if the database is reachable
+func (ss *SQLiteChatStorage) Ping() error {
+	ctx, cancel := context.WithTimeout(ss.ctx, 5*time.Second)
+	defer cancel()
+
+	return ss.db.PingContext(ctx)
+}
+
+// Clean up resources
+func (ss *SQLiteChatStorage) Close() error {
+	return ss.db.Close()
+}
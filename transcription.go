@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// Transcription backends selectable through TRANSCRIPTION_BACKEND
+const (
+	TranscriptionBackendNone    = "none"
+	TranscriptionBackendAPI     = "api"     // OpenAI-compatible /audio/transcriptions endpoint
+	TranscriptionBackendCommand = "command" // Local whisper-style binary
+)
+
+// Transcriber turns speech into text. filename tells the audio format.
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio []byte, filename string) (string, error)
+}
+
+// NewTranscriber creates the configured transcription backend, nil when disabled
+func NewTranscriber(config Config) Transcriber {
+	switch config.Transcription.Backend {
+	case TranscriptionBackendAPI:
+		provider := config.LLMProviders[config.Transcription.Provider]
+		return &APITranscriber{
+			client: openai.NewClient(
+				option.WithBaseURL(provider.BaseURL),
+				option.WithAPIKey(provider.APIKey),
+			),
+			model: config.Transcription.Model,
+		}
+	case TranscriptionBackendCommand:
+		return &CommandTranscriber{args: config.Transcription.Command}
+	default:
+		return nil
+	}
+}
+
+// APITranscriber transcribes with an OpenAI-compatible /audio/transcriptions endpoint
+type APITranscriber struct {
+	client openai.Client
+	model  string
+}
+
+func (t *APITranscriber) Transcribe(ctx context.Context, audio []byte, filename string) (string, error) {
+	resp, err := t.client.Audio.Transcriptions.New(ctx, openai.AudioTranscriptionNewParams{
+		File:  openai.File(bytes.NewReader(audio), filename, ""),
+		Model: openai.AudioModel(t.model),
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Text, nil
+}
+
+// CommandTranscriber runs a local command on the audio file and reads the
+// transcript from its output. The "{file}" argument is replaced by the file
+// path, which is appended when no argument contains it.
+type CommandTranscriber struct {
+	args []string
+}
+
+func (t *CommandTranscriber) Transcribe(ctx context.Context, audio []byte, filename string) (string, error) {
+	tmpFile, err := os.CreateTemp("", "voice-*"+filepath.Ext(filename))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(audio)
+	tmpFile.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	args := make([]string, 0, len(t.args)+1)
+	replaced := false
+	for _, arg := range t.args {
+		if strings.Contains(arg, "{file}") {
+			arg = strings.ReplaceAll(arg, "{file}", tmpFile.Name())
+			replaced = true
+		}
+		args = append(args, arg)
+	}
+	if !replaced {
+		args = append(args, tmpFile.Name())
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("transcription command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// voiceFile returns the file of a spoken message, voice notes and video notes,
+// named with an extension transcription backends recognize
+func voiceFile(message *models.Message) (fileID, filename string, ok bool) {
+	switch {
+	case message.Voice != nil:
+		return message.Voice.FileID, "voice.ogg", true
+	case message.VideoNote != nil:
+		return message.VideoNote.FileID, "video.mp4", true
+	default:
+		return "", "", false
+	}
+}
+
+// transcribeVoice transcribes a spoken message and stores the transcript as
+// its text, returning the transcript or an empty string on failure
+func transcribeVoice(ctx context.Context, b *bot.Bot, message *models.Message) string {
+	fileID, filename, ok := voiceFile(message)
+	if !ok {
+		return ""
+	}
+
+	audio, err := downloadFile(ctx, b, fileID, telegramMaxDownloadSize)
+	if err != nil {
+		log.Printf("Error downloading voice message %d in chat %d: %v", message.ID, message.Chat.ID, err)
+		return ""
+	}
+
+	text, err := transcriber.Transcribe(ctx, audio, filename)
+	if err != nil {
+		log.Printf("Error transcribing voice message %d in chat %d: %v", message.ID, message.Chat.ID, err)
+		return ""
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+
+	if _, err := chatStorage.UpdateMessage(message.Chat.ID, message.ID, func(stored *ChatMessage) {
+		stored.Text = text
+	}); err != nil {
+		log.Printf("Error storing transcript of message %d in chat %d: %v", message.ID, message.Chat.ID, err)
+	}
+	return text
+}
+
+// transcribeVoiceMiddleware turns voice and video notes into text messages, so
+// the rest of the chain handles them like typed messages
+// Note: Messages are already stored by storeMessageMiddleware before reaching this middleware
+func transcribeVoiceMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		if transcriber != nil && update.Message != nil && update.Message.Text == "" {
+			if text := transcribeVoice(ctx, b, update.Message); text != "" {
+				update.Message.Text = text
+			}
+		}
+
+		next(ctx, b, update)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// chatActionInterval is how often the chat action is refreshed, Telegram clears it after about five seconds
+const chatActionInterval = 4 * time.Second
+
+// startChatAction shows action (e.g. typing) in the chat until the returned function is called
+func startChatAction(ctx context.Context, b *bot.Bot, chatID int64, action models.ChatAction) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(chatActionInterval)
+		defer ticker.Stop()
+
+		for {
+			_, err := b.SendChatAction(ctx, &bot.SendChatActionParams{
+				ChatID: chatID,
+				Action: action,
+			})
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Error sending chat action: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// replyDelay returns how long a human would take to type text in chatID,
+// excluding the time already spent generating it
+func replyDelay(chatID int64, text string, elapsed time.Duration) time.Duration {
+	perChar := loadChatSettings(chatID).ReplyDelay(chatID)
+
+	delay := min(time.Duration(utf8.RuneCountInString(text))*perChar, appConfig.ReplyDelayMax)
+	return max(delay-elapsed, 0)
+}
+
+// waitReplyDelay sleeps for the human-like typing delay of text, returning false if ctx ends first
+func waitReplyDelay(ctx context.Context, chatID int64, text string, elapsed time.Duration) bool {
+	delay := replyDelay(chatID, text, elapsed)
+	if delay == 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/shared"
+)
+
+// UserMemory is a lasting fact the character remembers about a chat member
+type UserMemory struct {
+	ID       int    `json:"id"`
+	UserID   int64  `json:"user_id"`
+	UserName string `json:"user_name,omitempty"`
+	Fact     string `json:"fact"`
+	Date     int64  `json:"date"` // When it was learned
+}
+
+// ChatMemories are the memories of the members of a chat, along with how far
+// its history has been read for them
+type ChatMemories struct {
+	Memories      []UserMemory `json:"memories,omitempty"`
+	NextID        int          `json:"next_id,omitempty"`
+	LastMessageID int          `json:"last_message_id,omitempty"` // Newest message already read
+}
+
+func (m ChatMemories) clone() ChatMemories {
+	m.Memories = slices.Clone(m.Memories)
+	return m
+}
+
+// ForUser returns the memories about userID, oldest first
+func (m ChatMemories) ForUser(userID int64) []UserMemory {
+	var result []UserMemory
+	for _, memory := range m.Memories {
+		if memory.UserID == userID {
+			result = append(result, memory)
+		}
+	}
+	return result
+}
+
+// add remembers fact about userID, dropping their oldest memories beyond MEMORY_MAX_PER_USER
+func (m *ChatMemories) add(userID int64, userName, fact string, date int64) {
+	m.NextID++
+	m.Memories = append(m.Memories, UserMemory{ID: m.NextID, UserID: userID, UserName: userName, Fact: fact, Date: date})
+
+	if excess := len(m.ForUser(userID)) - appConfig.MemoryMaxPerUser; excess > 0 {
+		m.remove(func(memory UserMemory) bool {
+			if memory.UserID != userID || excess == 0 {
+				return false
+			}
+			excess--
+			return true
+		})
+	}
+}
+
+// remove drops the memories matching drop and returns how many were dropped
+func (m *ChatMemories) remove(drop func(UserMemory) bool) int {
+	before := len(m.Memories)
+	m.Memories = slices.DeleteFunc(m.Memories, drop)
+	return before - len(m.Memories)
+}
+
+// memoriesMu serializes the changes to memories, made by extractions and commands
+var memoriesMu sync.Mutex
+
+// updateMemories applies update to the memories of chatID and stores them
+func updateMemories(chatID int64, update func(*ChatMemories)) error {
+	memoriesMu.Lock()
+	defer memoriesMu.Unlock()
+
+	memories, err := chatStorage.GetMemories(chatID)
+	if err != nil {
+		return err
+	}
+	update(&memories)
+	return chatStorage.SetMemories(chatID, memories)
+}
+
+// memorableMessage reports whether message may tell something about its sender
+func memorableMessage(message ChatMessage) bool {
+	if message.Deleted || message.IsFromBot || message.FromID == 0 {
+		return false
+	}
+	return message.Caption != "" || message.Text != "" && !strings.HasPrefix(message.Text, "/")
+}
+
+// speakerMemories returns what the character remembers about the senders of
+// messages, as JSON for the reply prompt
+func speakerMemories(chatID int64, messages []ChatMessage) string {
+	memories, err := chatStorage.GetMemories(chatID)
+	if err != nil {
+		log.Printf("Error getting memories of chat %d: %v", chatID, err)
+		return "[]"
+	}
+
+	type promptMemory struct {
+		User   string `json:"user"`
+		UserID int64  `json:"user_id"`
+		Fact   string `json:"fact"`
+	}
+	result := []promptMemory{}
+	for _, memory := range memories.Memories {
+		if slices.ContainsFunc(messages, func(m ChatMessage) bool { return m.FromID == memory.UserID }) {
+			result = append(result, promptMemory{User: memory.UserName, UserID: memory.UserID, Fact: memory.Fact})
+		}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Error marshaling memories: %v", err)
+		return "[]"
+	}
+	return string(data)
+}
+
+// memoryExtraction tracks the messages received by each chat since its last
+// memory extraction, and the extractions in progress
+var memoryExtraction = struct {
+	sync.Mutex
+	counts  map[int64]int
+	running map[int64]bool
+}{counts: make(map[int64]int), running: make(map[int64]bool)}
+
+// memoryExtractTimeout bounds a memory extraction, which runs in the background
+const memoryExtractTimeout = 2 * time.Minute
+
+// collectMemoriesMiddleware starts a memory extraction in the background every
+// MEMORY_EXTRACT_EVERY messages of a chat
+// Note: Messages are already stored, transcribed and described before reaching this middleware
+func collectMemoriesMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		if appConfig.MemoryExtractEvery > 0 && update.Message != nil && update.Message.From != nil && !update.Message.From.IsBot {
+			chatID := update.Message.Chat.ID
+
+			memoryExtraction.Lock()
+			memoryExtraction.counts[chatID]++
+			due := memoryExtraction.counts[chatID] >= appConfig.MemoryExtractEvery && !memoryExtraction.running[chatID]
+			if due {
+				memoryExtraction.counts[chatID] = 0
+				memoryExtraction.running[chatID] = true
+			}
+			memoryExtraction.Unlock()
+
+			if due {
+				go func() {
+					defer func() {
+						memoryExtraction.Lock()
+						delete(memoryExtraction.running, chatID)
+						memoryExtraction.Unlock()
+					}()
+					extractMemories(chatID)
+				}()
+			}
+		}
+
+		next(ctx, b, update)
+	}
+}
+
+// memoryResponse represents the JSON structure returned by the memory model
+type memoryResponse struct {
+	Memories []struct {
+		UserID int64  `json:"user_id"`
+		Fact   string `json:"fact"`
+	} `json:"memories"`
+	Forget []int `json:"forget"`
+}
+
+// extractMemories reads the messages of chatID received since the last
+// extraction and stores the facts they reveal about their senders
+func extractMemories(chatID int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), memoryExtractTimeout)
+	defer cancel()
+
+	memories, err := chatStorage.GetMemories(chatID)
+	if err != nil {
+		log.Printf("Error getting memories of chat %d: %v", chatID, err)
+		return
+	}
+
+	budget := llmRegistry.ContextTokens(LLMTaskMemory)
+	state, ok := chatStorage.GetChatState(chatID, historyFetchLimit(budget))
+	if !ok {
+		return
+	}
+
+	var unread []ChatMessage
+	senders := make(map[int64]bool)
+	for _, message := range state.Messages {
+		if message.ID > memories.LastMessageID {
+			unread = append(unread, message)
+			if memorableMessage(message) {
+				senders[message.FromID] = true
+			}
+		}
+	}
+	if len(senders) == 0 {
+		return
+	}
+
+	// Only the memories of the senders, so the model can spot outdated ones
+	known := []UserMemory{}
+	for _, memory := range memories.Memories {
+		if senders[memory.UserID] {
+			known = append(known, memory)
+		}
+	}
+	knownJSON, err := json.Marshal(known)
+	if err != nil {
+		log.Printf("Error marshaling memories: %v", err)
+		return
+	}
+	prompt := strings.Replace(promptExtractMemories, "{{MEMORIES}}", string(knownJSON), 1)
+
+	// Read the oldest unread messages first, the others are left for the next
+	// extraction, which starts after the last message read here
+	var messages []ChatMessage
+	names := make(map[int64]string)
+	lastID := memories.LastMessageID
+	used, available := 0, budget-estimateTokens(prompt)
+	for _, message := range unread {
+		if memorableMessage(message) {
+			message = truncateMessage(message)
+			cost := estimateMessageTokens(message)
+			if used+cost > available && len(messages) > 0 {
+				break
+			}
+			used += cost
+			messages = append(messages, message)
+			names[message.FromID] = message.FromUser
+		}
+		lastID = message.ID
+	}
+
+	messagesJSON, err := json.Marshal(messages)
+	if err != nil {
+		log.Printf("Error marshaling messages: %v", err)
+		return
+	}
+	prompt = strings.Replace(prompt, "{{MESSAGES}}", string(messagesJSON), 1)
+
+	resp, err := llmRegistry.Complete(ctx, LLMTaskMemory, openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.UserMessage(prompt),
+		},
+		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
+			OfJSONObject: &shared.ResponseFormatJSONObjectParam{},
+		},
+	})
+	if err != nil {
+		log.Printf("Error extracting memories of chat %d: %v", chatID, err)
+		return
+	}
+	if len(resp.Choices) == 0 {
+		log.Printf("Memory model returned empty response")
+		return
+	}
+
+	var result memoryResponse
+	if err := json.Unmarshal([]byte(resp.Choices[0].Message.Content), &result); err != nil {
+		log.Printf("Error parsing memory response: %v", err)
+		return
+	}
+
+	added, forgotten := 0, 0
+	now := time.Now().Unix()
+	err = updateMemories(chatID, func(m *ChatMemories) {
+		forgotten = m.remove(func(memory UserMemory) bool {
+			_, sender := names[memory.UserID]
+			return sender && slices.Contains(result.Forget, memory.ID)
+		})
+		for _, memory := range result.Memories {
+			name, sender := names[memory.UserID]
+			fact := strings.TrimSpace(memory.Fact)
+			if !sender || fact == "" {
+				continue
+			}
+			m.add(memory.UserID, name, fact, now)
+			added++
+		}
+		m.LastMessageID = max(m.LastMessageID, lastID)
+	})
+	if err != nil {
+		log.Printf("Error storing memories of chat %d: %v", chatID, err)
+		return
+	}
+	log.Printf("Read %d messages of chat %d for memories: %d remembered, %d forgotten", len(messages), chatID, added, forgotten)
+}
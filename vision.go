@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+)
+
+const (
+	// maxImageSize bounds the images downloaded for the vision model
+	maxImageSize = 10 << 20
+	// visionImageMaxSide is the largest photo size sent to the vision model,
+	// bigger sizes add cost without details worth describing
+	visionImageMaxSide = 1280
+	// maxCachedDescriptions bounds the description cache, stickers are sent over and over
+	maxCachedDescriptions = 1000
+)
+
+// imageDescriptions caches descriptions by the unique ID of the file
+var imageDescriptions = struct {
+	sync.Mutex
+	byFile map[string]string
+}{byFile: make(map[string]string)}
+
+// imageFile returns the file of the image in message that the vision model can
+// see: photos and static stickers
+func imageFile(message *models.Message) (fileID, uniqueID, mimeType string, ok bool) {
+	switch {
+	case len(message.Photo) > 0:
+		// Sizes are sorted from the smallest, take the largest within visionImageMaxSide
+		photo := message.Photo[0]
+		for _, size := range message.Photo[1:] {
+			if max(size.Width, size.Height) <= visionImageMaxSide {
+				photo = size
+			}
+		}
+		return photo.FileID, photo.FileUniqueID, "image/jpeg", true
+	case message.Sticker != nil && !message.Sticker.IsAnimated && !message.Sticker.IsVideo:
+		return message.Sticker.FileID, message.Sticker.FileUniqueID, "image/webp", true
+	default:
+		return "", "", "", false
+	}
+}
+
+// downloadFile downloads a file sent to the bot, failing if it exceeds maxSize bytes
+func downloadFile(ctx context.Context, b *bot.Bot, fileID string, maxSize int64) ([]byte, error) {
+	file, err := b.GetFile(ctx, &bot.GetFileParams{FileID: fileID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+	if file.FileSize > maxSize {
+		return nil, fmt.Errorf("file too large: %d bytes", file.FileSize)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.FileDownloadLink(file), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download file: HTTP status code %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file too large: more than %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// describeImage asks the vision model to describe the image of message
+func describeImage(ctx context.Context, b *bot.Bot, message *models.Message, fileID, mimeType string) (string, error) {
+	data, err := downloadFile(ctx, b, fileID, maxImageSize)
+	if err != nil {
+		return "", err
+	}
+
+	caption := ""
+	if message.Caption != "" {
+		caption = "The sender wrote along with it: " + message.Caption
+	} else if message.Sticker != nil && message.Sticker.Emoji != "" {
+		caption = "It is a sticker associated with the emoji " + message.Sticker.Emoji
+	}
+	prompt := strings.Replace(promptDescribeImage, "{{CAPTION}}", caption, 1)
+
+	resp, err := llmRegistry.Complete(ctx, LLMTaskVision, openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.UserMessage([]openai.ChatCompletionContentPartUnionParam{
+				openai.TextContentPart(prompt),
+				openai.ImageContentPart(openai.ChatCompletionContentPartImageImageURLParam{
+					URL: "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data),
+				}),
+			}),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("empty response")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// storeImageDescription describes the image of message and stores the
+// description with the message, reusing the one of a file already seen
+func storeImageDescription(ctx context.Context, b *bot.Bot, message *models.Message) {
+	fileID, uniqueID, mimeType, ok := imageFile(message)
+	if !ok {
+		return
+	}
+
+	imageDescriptions.Lock()
+	description, cached := imageDescriptions.byFile[uniqueID]
+	imageDescriptions.Unlock()
+
+	if !cached {
+		var err error
+		if description, err = describeImage(ctx, b, message, fileID, mimeType); err != nil {
+			log.Printf("Error describing image of message %d in chat %d: %v", message.ID, message.Chat.ID, err)
+			return
+		}
+
+		imageDescriptions.Lock()
+		if len(imageDescriptions.byFile) >= maxCachedDescriptions {
+			clear(imageDescriptions.byFile)
+		}
+		imageDescriptions.byFile[uniqueID] = description
+		imageDescriptions.Unlock()
+	}
+
+	if _, err := chatStorage.UpdateMessage(message.Chat.ID, message.ID, func(stored *ChatMessage) {
+		stored.Description = description
+	}); err != nil {
+		log.Printf("Error storing image description of message %d in chat %d: %v", message.ID, message.Chat.ID, err)
+	}
+}
+
+// describeImageMiddleware describes the photos and static stickers sent in chats
+// before they are answered, so the character knows what was shared
+// Note: Messages are already stored by storeMessageMiddleware before reaching this middleware
+func describeImageMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		if appConfig.DescribeImages && update.Message != nil {
+			storeImageDescription(ctx, b, update.Message)
+		}
+
+		next(ctx, b, update)
+	}
+}
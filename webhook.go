@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-telegram/bot"
+)
+
+// webhookURL returns the public URL Telegram sends updates to
+func webhookURL(config *Config) string {
+	return strings.TrimSuffix(config.WebhookURL, "/") + config.WebhookPath
+}
+
+// registerWebhook points Telegram to this deployment. Every replica registers the
+// same URL on startup, so it's safe to run several of them behind a load balancer.
+func registerWebhook(ctx context.Context, b *bot.Bot, config *Config) error {
+	_, err := b.SetWebhook(ctx, &bot.SetWebhookParams{
+		URL:         webhookURL(config),
+		SecretToken: config.WebhookSecretToken,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set webhook: %w", err)
+	}
+
+	log.Printf("Webhook registered at %s", webhookURL(config))
+	return nil
+}
+
+// unregisterWebhook removes any webhook left by a previous deployment, since
+// Telegram refuses long polling while a webhook is set
+func unregisterWebhook(ctx context.Context, b *bot.Bot) error {
+	if _, err := b.DeleteWebhook(ctx, &bot.DeleteWebhookParams{}); err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return nil
+}
+
+// webhookHandler verifies the secret token Telegram sends with every update and
+// rejects anything else before handing the request to the bot
+func webhookHandler(b *bot.Bot, secretToken string) http.HandlerFunc {
+	next := b.WebhookHandler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secretToken)) != 1 {
+			log.Printf("Rejecting webhook request from %s: invalid secret token", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}